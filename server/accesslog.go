@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// statusRecorder records the status code and the number of body bytes
+// written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// accessEntry is one request as written by the json log format.
+type accessEntry struct {
+	TS         time.Time `json:"ts"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+	Encoding   string    `json:"encoding"`
+}
+
+// withAccessLog logs one line per request with its method, path, status,
+// response size and duration, as plain text or, for format "json", as a
+// JSON object. It should wrap the compression middleware so the byte count
+// is what was actually sent. The client address is derived as by clientIP.
+// Requests for the paths in skip are served without a line. With cache set,
+// the json encoding field also tells how a compressed copy was found, as
+// in gzip;cache=hit; see noteCache.
+func withAccessLog(format string, skip []string, cache bool, proxies []netip.Prefix, next http.Handler) http.Handler {
+	jsonLog := log.New(log.Writer(), "", 0)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(skip, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var note string
+		if cache && format == "json" {
+			r = r.WithContext(context.WithValue(r.Context(), cacheNoteKey{}, &note))
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		client := clientIP(r, proxies)
+
+		if format != "json" {
+			log.Printf("%s %s %s %d %d %s", client, r.Method, r.URL.RequestURI(), rec.status, rec.bytes, elapsed)
+			return
+		}
+		b, err := json.Marshal(accessEntry{
+			TS:         start.UTC(),
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMS: float64(elapsed.Microseconds()) / 1000,
+			RemoteAddr: client,
+			Encoding:   encoding(rec.Header(), note),
+		})
+		if err != nil {
+			log.Printf("access log: %v", err)
+			return
+		}
+		jsonLog.Print(string(b))
+	})
+}
+
+// cacheNoteKey is the context key for the note that noteCache fills in.
+type cacheNoteKey struct{}
+
+// noteCache records, for the access log of the request in ctx, the last
+// lookup of a compressed copy from source, cache or sidecar, and its result,
+// hit or miss.
+func noteCache(ctx context.Context, source, result string) {
+	if note, ok := ctx.Value(cacheNoteKey{}).(*string); ok {
+		*note = source + "=" + result
+	}
+}
+
+// encoding is the encoding field of a json access log entry: the response's
+// Content-Encoding, followed by the cache note if there is one.
+func encoding(h http.Header, note string) string {
+	enc := h.Get("Content-Encoding")
+	if note == "" {
+		return enc
+	}
+	if enc == "" {
+		enc = "identity"
+	}
+	return enc + ";" + note
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentials maps user names to either a plain password or, for entries
+// from an htpasswd file, a bcrypt hash. dummy, set when there are hashes, is
+// a bcrypt hash as costly as the dearest of them that unknown users are
+// checked against, so that a wrong name takes as long as a wrong password.
+type credentials struct {
+	users map[string]string
+	dummy []byte
+}
+
+// loadHtpasswd reads user:hash lines as written by htpasswd -B.
+func loadHtpasswd(path string) (*credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := &credentials{users: make(map[string]string)}
+	cost := bcrypt.MinCost
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		c, err := bcrypt.Cost([]byte(hash))
+		if !ok || !strings.HasPrefix(hash, "$2") || err != nil {
+			return nil, fmt.Errorf("%s:%d: want user:bcrypt-hash", path, n)
+		}
+		creds.users[user] = hash
+		cost = max(cost, c)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds.users) > 0 {
+		if creds.dummy, err = bcrypt.GenerateFromPassword([]byte("unknown user"), cost); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return creds, nil
+}
+
+func (c *credentials) valid(user, pass string) bool {
+	want, ok := c.users[user]
+	if !ok {
+		// Spend comparable time on unknown users: a bcrypt comparison when
+		// any user has a hash, as that is what a known user would cost.
+		want = pass + "x"
+		if c.dummy != nil {
+			want = string(c.dummy)
+		}
+	}
+	var match bool
+	if strings.HasPrefix(want, "$2") {
+		match = bcrypt.CompareHashAndPassword([]byte(want), []byte(pass)) == nil
+	} else {
+		match = subtle.ConstantTimeCompare([]byte(want), []byte(pass)) == 1
+	}
+	return ok && match
+}
+
+// withBasicAuth answers 401 to requests without valid credentials.
+func withBasicAuth(creds *credentials, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !creds.valid(user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry", charset="UTF-8"`)
+			httpError(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
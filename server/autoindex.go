@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// autoIndexPage is the landing page -auto-index generates.
+var autoIndexPage = template.Must(template.New("index").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Registry files</title>
+<style>
+body { font: 16px/1.5 system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .25rem .75rem .25rem 0; }
+td.size { text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+<h1>Registry files</h1>
+{{if .}}<table>
+<tr><th>File</th><th>Size</th><th>Modified</th></tr>
+{{range .}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+{{else}}<p>No registry files yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// autoIndexRow is one file as shown on the page.
+type autoIndexRow struct {
+	Name, Href, Size, ModTime string
+}
+
+// autoIndex renders a page listing the .tsv files under root, rescanning at
+// most once per ttl. It replaces the file server's bare listing at / for
+// directories of snapshots that come without a page of their own.
+type autoIndex struct {
+	root http.FileSystem
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	scanned time.Time
+	body    []byte
+}
+
+func newAutoIndex(root http.FileSystem, ttl time.Duration) *autoIndex {
+	return &autoIndex{root: root, ttl: ttl}
+}
+
+func (a *autoIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := a.get()
+	if err != nil {
+		log.Printf("auto-index: %v", err)
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writeBody(w, r, body)
+}
+
+func (a *autoIndex) get() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.body != nil && time.Since(a.scanned) < a.ttl {
+		return a.body, nil
+	}
+
+	var entries []indexEntry
+	if err := walkFiles(a.root, "/", func(name string, e indexEntry) {
+		if path.Ext(name) == ".tsv" {
+			entries = append(entries, e)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(x, y indexEntry) int { return strings.Compare(x.Name, y.Name) })
+	rows := make([]autoIndexRow, len(entries))
+	for i, e := range entries {
+		rows[i] = autoIndexRow{
+			Name:    strings.TrimPrefix(e.Name, "/"),
+			Href:    "." + e.Name,
+			Size:    humanSize(e.Size),
+			ModTime: e.ModTime.Format("2006-01-02 15:04 MST"),
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := autoIndexPage.Execute(&buf, rows); err != nil {
+		return nil, err
+	}
+	a.body, a.scanned = buf.Bytes(), time.Now()
+	return a.body, nil
+}
+
+// humanSize formats n bytes with a binary unit, e.g. 1.5 KiB.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, unit := float64(n), 0
+	for f >= 1024 && unit < 4 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, "KMGT"[unit-1])
+}
+
+// withAutoIndex serves index for / when root has no index page there, and
+// passes everything else to next.
+func withAutoIndex(root http.FileSystem, index, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			if f, err := root.Open("/index.html"); err == nil {
+				f.Close()
+			} else {
+				index.ServeHTTP(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
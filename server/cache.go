@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheRule sets Cache-Control on responses whose path matches Pattern.
+// Patterns use path.Match syntax against the path within its mount; a
+// pattern without a slash, such as *.png, matches the file name at any depth.
+//
+// StaleRevalidate and StaleIfError, when set, append stale-while-revalidate
+// and stale-if-error to CacheControl, letting a CDN go on serving a copy
+// that has just expired while it fetches a fresh one, or while the origin
+// fails.
+type cacheRule struct {
+	Pattern      string `yaml:"pattern"`
+	CacheControl string `yaml:"cache-control"`
+
+	StaleRevalidate time.Duration `yaml:"stale-while-revalidate"`
+	StaleIfError    time.Duration `yaml:"stale-if-error"`
+}
+
+// defaultCacheRules apply when the config file sets no cache-rules. The
+// registry file itself is covered by the rule built from the -registry-*
+// flags, which follows these.
+var defaultCacheRules = []cacheRule{
+	{Pattern: "/registry.*.tsv", CacheControl: "public, max-age=31536000, immutable"},
+}
+
+// cacheControl builds a Cache-Control value one directive at a time.
+type cacheControl []string
+
+// add appends directive as written, such as public or no-cache.
+func (c cacheControl) add(directive string) cacheControl {
+	return append(c, directive)
+}
+
+// seconds appends a directive such as max-age=60 with d in whole seconds.
+func (c cacheControl) seconds(name string, d time.Duration) cacheControl {
+	return append(c, name+"="+strconv.FormatInt(int64(d/time.Second), 10))
+}
+
+func (c cacheControl) String() string { return strings.Join(c, ", ") }
+
+// value returns the Cache-Control the rule sets.
+func (c cacheRule) value() string {
+	var cc cacheControl
+	if c.CacheControl != "" {
+		cc = cc.add(c.CacheControl)
+	}
+	if c.StaleRevalidate > 0 {
+		cc = cc.seconds("stale-while-revalidate", c.StaleRevalidate)
+	}
+	if c.StaleIfError > 0 {
+		cc = cc.seconds("stale-if-error", c.StaleIfError)
+	}
+	return cc.String()
+}
+
+func (c cacheRule) matches(p string) bool {
+	if !strings.Contains(c.Pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(c.Pattern, p)
+	return ok
+}
+
+func (c cacheRule) validate() error {
+	if c.Pattern == "" {
+		return fmt.Errorf("rule without a pattern")
+	}
+	if _, err := path.Match(c.Pattern, ""); err != nil {
+		return fmt.Errorf("pattern %q: %w", c.Pattern, err)
+	}
+	if c.StaleRevalidate < 0 || c.StaleIfError < 0 {
+		return fmt.Errorf("pattern %q: stale-while-revalidate and stale-if-error must not be negative", c.Pattern)
+	}
+	return nil
+}
+
+// cacheControlFor returns the Cache-Control of the first rule matching p.
+func cacheControlFor(rules []cacheRule, p string) string {
+	for _, rule := range rules {
+		if rule.matches(p) {
+			return rule.value()
+		}
+	}
+	return ""
+}
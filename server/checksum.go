@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumEntry is a file's SHA-256 along with the file state it was
+// computed for.
+type checksumEntry struct {
+	size int64
+	mod  time.Time
+	sum  []byte
+}
+
+// sumCache keeps the SHA-256 of files by name until their size or mtime
+// changes.
+type sumCache struct {
+	mu   sync.Mutex
+	sums map[string]checksumEntry
+}
+
+func newSumCache() *sumCache {
+	return &sumCache{sums: make(map[string]checksumEntry)}
+}
+
+// sum returns the SHA-256 of f, the file called name with info fi, reading
+// it only when the cached sum is missing or stale.
+func (c *sumCache) sum(name string, f io.Reader, fi fs.FileInfo) ([]byte, error) {
+	if sum, ok := c.lookup(name, fi); ok {
+		return sum, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	c.store(name, fi, sum)
+	return sum, nil
+}
+
+// lookup returns the sum cached under name if it was computed for the
+// file state in fi.
+func (c *sumCache) lookup(name string, fi fs.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.sums[name]
+	c.mu.Unlock()
+	if ok && e.size == fi.Size() && e.mod.Equal(fi.ModTime()) {
+		return e.sum, true
+	}
+	return nil, false
+}
+
+// store caches sum under name for the file state in fi.
+func (c *sumCache) store(name string, fi fs.FileInfo, sum []byte) {
+	c.mu.Lock()
+	c.sums[name] = checksumEntry{fi.Size(), fi.ModTime(), sum}
+	c.mu.Unlock()
+}
+
+// withChecksums answers <path>.sha256 with the hex SHA-256 of the file at
+// <path>, in the format sha256sum -c reads, so that clients can check a
+// cached copy with one small request. The sum is of the file as stored,
+// whatever encoding it is sent with. It is computed on first request and
+// kept in sums until the file's size or mtime changes. A real .sha256 file
+// in root is served as is.
+func withChecksums(root http.FileSystem, sums *sumCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(r.URL.Path, ".sha256")
+		if !ok || name == "" || strings.HasSuffix(name, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if f, err := root.Open(r.URL.Path); err == nil {
+			f.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := root.Open(name)
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			notFound(w, r)
+			return
+		}
+
+		b, err := sums.sum(name, f, fi)
+		if err != nil {
+			log.Printf("checksum %s: %v", name, err)
+			httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		sum := hex.EncodeToString(b)
+
+		body := fmt.Sprintf("%s  %s\n", sum, path.Base(name))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", `"`+sum[:32]+`"`)
+		http.ServeContent(w, r, r.URL.Path, fi.ModTime(), strings.NewReader(body))
+	})
+}
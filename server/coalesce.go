@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// bufferedResponse is a complete response recorded in memory.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// boundedHandler is a handler that can tell whether its response to a
+// request is small enough to hold in memory.
+type boundedHandler interface {
+	http.Handler
+	bounded(r *http.Request) bool
+}
+
+// errAborted reports that the shared run of next cut its response short
+// with http.ErrAbortHandler.
+var errAborted = errors.New("response aborted")
+
+// errNotShared reports a shared run that produced nothing worth handing to
+// the other callers, so that each serves itself instead.
+var errNotShared = errors.New("response not shared")
+
+// withCoalescing lets concurrent requests for the same URL share one run of
+// next: the first runs it into memory and every request waiting meanwhile
+// gets a copy of that response. It is for generated responses that are
+// expensive to build, such as -json-path pages; requests next does not
+// call bounded are served directly so that they keep streaming. Only the
+// headers next sets itself are recorded, so per-request headers from outer
+// middleware are unaffected.
+//
+// The shared run belongs to no single caller: it keeps going when the one
+// that started it leaves, with a deadline of its own d after it starts
+// when d is positive, and each caller stops waiting on its own once its
+// context is done. A run that writes nothing or ends with its context done
+// is not shared; every caller then serves itself.
+func withCoalescing(d time.Duration, next boundedHandler) http.Handler {
+	var g singleflight.Group
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !next.bounded(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.URL.RequestURI()
+		ch := g.DoChan(key, func() (_ any, err error) {
+			ctx, cancel := context.WithoutCancel(r.Context()), context.CancelFunc(func() {})
+			if d > 0 {
+				ctx, cancel = context.WithTimeout(ctx, d)
+			}
+			defer cancel()
+			// DoChan has no caller to hand a panic to and would crash the
+			// process, so every panic ends here. An abort, as registryJSON
+			// does when the file changes under it, is an error; nothing
+			// has been sent yet, so each caller can answer 500 instead.
+			defer func() {
+				if p := recover(); p != nil {
+					if p != http.ErrAbortHandler {
+						log.Printf("coalesce %s: panic: %v\n%s", key, p, debug.Stack())
+					}
+					err = errAborted
+				}
+				if ctx.Err() != nil {
+					g.Forget(key)
+					err = errNotShared
+				}
+			}()
+			b := &bufferedResponse{header: make(http.Header)}
+			next.ServeHTTP(b, r.WithContext(ctx))
+			if b.code == 0 {
+				g.Forget(key)
+				return nil, errNotShared
+			}
+			return b, nil
+		})
+		var res singleflight.Result
+		select {
+		case res = <-ch:
+		case <-r.Context().Done():
+			return // withTimeout or the client gave up
+		}
+		switch res.Err {
+		case nil:
+		case errNotShared:
+			next.ServeHTTP(w, r)
+			return
+		default:
+			httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		b := res.Val.(*bufferedResponse)
+		h := w.Header()
+		for k, vv := range b.header {
+			h[k] = slices.Clone(vv)
+		}
+		h.Set("Content-Length", strconv.Itoa(b.body.Len()))
+		w.WriteHeader(b.code)
+		if r.Method != http.MethodHead {
+			w.Write(b.body.Bytes())
+		}
+	})
+}
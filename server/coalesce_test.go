@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler counts its runs and holds each until release is closed.
+type countingHandler struct {
+	runs    atomic.Int32
+	release chan struct{}
+	limited bool
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.runs.Add(1)
+	<-c.release
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`[{"slug":"demo"}]` + "\n"))
+}
+
+func (c *countingHandler) bounded(r *http.Request) bool { return c.limited }
+
+func TestCoalescing(t *testing.T) {
+	const n = 20
+	for _, tt := range []struct {
+		name    string
+		limited bool
+		runs    int32
+	}{
+		{"bounded", true, 1},
+		{"unbounded", false, n},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingHandler{release: make(chan struct{}), limited: tt.limited}
+			h := withCoalescing(0, next)
+
+			var arrived, done sync.WaitGroup
+			arrived.Add(n)
+			done.Add(n)
+			codes := make([]int, n)
+			for i := range n {
+				go func() {
+					defer done.Done()
+					w := httptest.NewRecorder()
+					arrived.Done()
+					h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/registry.json?limit=10", nil))
+					codes[i] = w.Code
+				}()
+			}
+			arrived.Wait()
+			// Give the last arrivals time to join the run in progress.
+			time.Sleep(50 * time.Millisecond)
+			close(next.release)
+			done.Wait()
+
+			if got := next.runs.Load(); got != tt.runs {
+				t.Errorf("handler ran %d times, want %d", got, tt.runs)
+			}
+			for i, code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("request %d: status %d", i, code)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescingAbort(t *testing.T) {
+	h := withCoalescing(0, abortingHandler{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/registry.json?limit=10", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+// abortingHandler cuts its response short as registryJSON does when the file
+// changes under it.
+type abortingHandler struct{}
+
+func (abortingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("[{"))
+	panic(http.ErrAbortHandler)
+}
+
+func (abortingHandler) bounded(r *http.Request) bool { return true }
+
+// leaderHandler signals started on its first run, then waits for release
+// and, like registryJSON, gives up without writing once its context is done.
+type leaderHandler struct {
+	started, release chan struct{}
+	runs             atomic.Int32
+}
+
+func (l *leaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.runs.Add(1) == 1 {
+		close(l.started)
+	}
+	select {
+	case <-l.release:
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`[{"slug":"demo"}]` + "\n"))
+}
+
+func (l *leaderHandler) bounded(r *http.Request) bool { return true }
+
+func TestCoalescingCancelledLeader(t *testing.T) {
+	next := &leaderHandler{started: make(chan struct{}), release: make(chan struct{})}
+	h := withCoalescing(0, next)
+	const target = "/registry.json?limit=10"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, http.MethodGet, target, nil))
+	}()
+	<-next.started
+
+	follower := httptest.NewRecorder()
+	followerDone := make(chan struct{})
+	go func() {
+		defer close(followerDone)
+		h.ServeHTTP(follower, httptest.NewRequest(http.MethodGet, target, nil))
+	}()
+	// Give the follower time to join the run, then drop the leader.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-leaderDone
+	close(next.release)
+	<-followerDone
+
+	if follower.Code != http.StatusOK || follower.Body.String() != `[{"slug":"demo"}]`+"\n" {
+		t.Errorf("follower got %d %q", follower.Code, follower.Body.String())
+	}
+	if got := next.runs.Load(); got != 1 {
+		t.Errorf("handler ran %d times, want 1", got)
+	}
+}
+
+// emptyHandler writes nothing on its first run and a body on later ones.
+type emptyHandler struct{ runs atomic.Int32 }
+
+func (e *emptyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.runs.Add(1) > 1 {
+		w.Write([]byte("[]\n"))
+	}
+}
+
+func (e *emptyHandler) bounded(r *http.Request) bool { return true }
+
+func TestCoalescingEmptyNotShared(t *testing.T) {
+	h := withCoalescing(0, &emptyHandler{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/registry.json?limit=10", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("got %d %q, want the caller's own response", w.Code, w.Body.String())
+	}
+}
+
+func TestCoalescingOwnDeadline(t *testing.T) {
+	next := &leaderHandler{started: make(chan struct{}), release: make(chan struct{})}
+	h := withCoalescing(20*time.Millisecond, next)
+	w := httptest.NewRecorder()
+	// The caller has no deadline, so only the shared run's own one ends
+	// the first run; the caller then serves itself, which release lets
+	// finish.
+	go func() {
+		<-next.started
+		time.Sleep(50 * time.Millisecond)
+		close(next.release)
+	}()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/registry.json?limit=10", nil))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if got := next.runs.Load(); got != 2 {
+		t.Errorf("handler ran %d times, want 2", got)
+	}
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// encoder is a streaming compressor such as *gzip.Writer or *brotli.Writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encoders maps a Content-Encoding token to a constructor for its writer.
+// The level applies to gzip and deflate; brotli always uses its default
+// level. deflate is raw DEFLATE, which is what the legacy clients asking for
+// it expect, rather than the zlib wrapping of RFC 9110.
+var encoders = map[string]func(w io.Writer, level int) (encoder, error){
+	"br": func(w io.Writer, _ int) (encoder, error) {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	},
+	"gzip": newPooledGzipWriter,
+	"deflate": func(w io.Writer, level int) (encoder, error) {
+		return flate.NewWriter(w, level)
+	},
+}
+
+// gzipPools holds idle gzip writers, indexed by compression level.
+var gzipPools [gzip.BestCompression + 1]sync.Pool
+
+// pooledGzipWriter returns its *gzip.Writer to the pool for its level once
+// closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func newPooledGzipWriter(w io.Writer, level int) (encoder, error) {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip level %d out of range", level)
+	}
+	pool := &gzipPools[level]
+	if gz, ok := pool.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return pooledGzipWriter{gz, pool}, nil
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return pooledGzipWriter{gz, pool}, nil
+}
+
+func (p pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	p.Writer.Reset(io.Discard)
+	p.pool.Put(p.Writer)
+	return err
+}
+
+// parseGzipLevel accepts a level from 1 to 9 or one of best, speed, default.
+func parseGzipLevel(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "best":
+		return gzip.BestCompression, nil
+	case "speed":
+		return gzip.BestSpeed, nil
+	case "default":
+		return 6, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+		return 0, fmt.Errorf("gzip level %q must be 1-9, best, speed or default", s)
+	}
+	return n, nil
+}
+
+// parseExts lowercases a list of file extensions and gives each a leading
+// dot, so that "SVG" and ".svg" are the same.
+func parseExts(list []string) ([]string, error) {
+	var out []string
+	for _, e := range list {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if strings.ContainsAny(e[1:], "./") {
+			return nil, fmt.Errorf("invalid extension %q", e)
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// parseEncodings validates and lowercases a list of encodings in preference
+// order.
+func parseEncodings(list []string) ([]string, error) {
+	var out []string
+	for _, e := range list {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if _, ok := encoders[e]; !ok {
+			return nil, fmt.Errorf("unsupported encoding %q", e)
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// parseAcceptEncoding maps each coding in an Accept-Encoding header to its
+// quality value, 1 when no q parameter is given.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		token, params, _ := strings.Cut(part, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			} else {
+				q = 0
+			}
+		}
+		accepted[token] = q
+	}
+	return accepted
+}
+
+// encodingQuality returns the quality accepted assigns to enc, falling back
+// to the "*" wildcard. Codings not mentioned at all are unacceptable.
+func encodingQuality(accepted map[string]float64, enc string) float64 {
+	if q, ok := accepted[enc]; ok {
+		return q
+	}
+	return accepted["*"]
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	return encodingQuality(parseAcceptEncoding(header), enc) > 0
+}
+
+// negotiateEncoding picks the acceptable encoding with the highest quality,
+// breaking ties by the order of prefs. It returns "" when none is acceptable,
+// or when the client explicitly rates identity above every encoding, as in
+// "identity, gzip;q=0.5"; an equal rating still compresses.
+func negotiateEncoding(r *http.Request, prefs []string) string {
+	accepted := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	best, bestQ := "", 0.0
+	for _, enc := range prefs {
+		if q := encodingQuality(accepted, enc); q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	if q, ok := accepted["identity"]; ok && q > bestQ {
+		return ""
+	}
+	return best
+}
+
+// identityEncoder passes bytes through unchanged.
+type identityEncoder struct {
+	io.Writer
+}
+
+func (identityEncoder) Flush() error { return nil }
+func (identityEncoder) Close() error { return nil }
+
+// compressResponseWriter defers the choice between compressing and passing
+// through until the body is known to reach minSize bytes, either from a
+// Content-Length header or by buffering up to minSize bytes of output.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string // "" to only add Vary, never compress
+	level    int
+	minSize  int
+
+	// types, when set, limits compression to responses whose Content-Type
+	// matches one of these media types. Either way, a Content-Type that
+	// matches deny more closely is never compressed; see mediaTypeRank.
+	types []string
+	deny  []string
+
+	// matchedEncodedETag is set when If-None-Match named the encoded
+	// representation, so a 304 must carry its tag.
+	matchedEncodedETag bool
+
+	// flushEvery, when positive, flushes the encoder after that many bytes
+	// of input so a long body starts reaching the client early.
+	flushEvery int
+	unflushed  int
+
+	// sniffing is set while a response without a Content-Type is held back
+	// for its type to be sniffed from at most sniffSize bytes of the body.
+	// A handler writing a large body in one go never grows the buffer past
+	// that, and a window too short for http.DetectContentType to place
+	// falls back to application/octet-stream, which goes out uncompressed.
+	sniffing  bool
+	sniffSize int
+
+	// debug reports the body size before and after compression in
+	// trailers, counted in inBytes and outBytes.
+	debug             bool
+	inBytes, outBytes int64
+
+	code int     // status passed to WriteHeader, 0 until called
+	buf  []byte  // output held back while undecided
+	w    encoder // nil until decided
+
+	// head is set for HEAD requests, whose encoder output is discarded
+	// rather than left for the server to count as the body length.
+	head bool
+
+	// digest, when set, replaces the Repr-Digest of the identity body
+	// with one of the compressed bytes. That is taken from sums under
+	// sumKey when a previous response for the same file state, encoding
+	// and level stored it there, and otherwise computed into sha and sent
+	// as a trailer. identity, when set, gives the digest of a body that
+	// goes out uncompressed after all.
+	digest   bool
+	sums     *sumCache
+	sumKey   string
+	fi       fs.FileInfo
+	sha      hash.Hash
+	identity func() string
+
+	// limit bounds the compressions running at once. held is set while
+	// this response has one of its slots, taken when it decides to
+	// compress and given back on Close.
+	limit *encodeLimit
+	held  bool
+	ctx   context.Context
+
+	// err is the first error writing to the client, usually because it
+	// went away. Once set nothing more is sent, not even the encoder's
+	// trailer on Close.
+	err error
+}
+
+// clientWriter is the connection end of a compressResponseWriter. It
+// records the first write error and fails every write after it without
+// touching the connection again.
+type clientWriter struct {
+	c *compressResponseWriter
+}
+
+func (cw clientWriter) Write(b []byte) (int, error) {
+	if cw.c.err != nil {
+		return 0, cw.c.err
+	}
+	n, err := cw.c.ResponseWriter.Write(b)
+	if err != nil {
+		cw.c.err = err
+	}
+	return n, err
+}
+
+func (c *compressResponseWriter) WriteHeader(code int) {
+	if c.code != 0 {
+		return
+	}
+	c.code = code
+
+	// Bodiless responses go out untouched, without a Content-Encoding.
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		if code == http.StatusNotModified && c.matchedEncodedETag {
+			c.setEncodedETag()
+		}
+		c.decide(false)
+		return
+	}
+	// Without a Content-Type there is nothing to match types against, so
+	// the decision waits for enough of the body to sniff one, as the
+	// server would on the first write.
+	if c.types != nil && c.sniffSize > 0 && !c.head && c.Header().Get("Content-Type") == "" {
+		c.sniffing = true
+		return
+	}
+	c.negotiate()
+}
+
+// negotiate decides on compression from the response headers, leaving it to
+// Write when the body is short of minSize and its length is not known.
+func (c *compressResponseWriter) negotiate() {
+	// A path that passed on its extension counts as an exact allow, so
+	// only an exact entry in the deny-set overrides it.
+	ct, allow := c.Header().Get("Content-Type"), exactMatch
+	if c.types != nil {
+		allow = mediaTypeRank(ct, c.types)
+	}
+	if allow <= mediaTypeRank(ct, c.deny) {
+		c.decide(false)
+		return
+	}
+	if c.types != nil {
+		c.Header().Add("Vary", "Accept-Encoding")
+	}
+	if c.encoding == "" {
+		c.decide(false)
+		return
+	}
+	if cl := c.Header().Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil {
+			// Periodic flushes cost some compression, which only pays off
+			// on bodies many intervals long.
+			if n < 4*c.flushEvery {
+				c.flushEvery = 0
+			}
+			c.decide(n >= c.minSize)
+		}
+	} else if c.minSize <= 0 {
+		c.decide(true)
+	}
+}
+
+// sniff sets the Content-Type from the body held so far followed by more,
+// which together are at most sniffSize bytes, and then makes the decision
+// WriteHeader put off.
+func (c *compressResponseWriter) sniff(more []byte) {
+	c.sniffing = false
+	window := append(c.buf[:len(c.buf):len(c.buf)], more...)
+	c.Header().Set("Content-Type", http.DetectContentType(window))
+	c.negotiate()
+}
+
+// decide commits the response headers. When compressing it drops any
+// Content-Length set for the uncompressed body, which no longer matches the
+// bytes sent on the wire.
+func (c *compressResponseWriter) decide(compress bool) {
+	// A HEAD response has no body to compress, so it needs no slot.
+	if compress && !c.head {
+		c.held = c.limit.acquire(c.ctx)
+		compress = c.held
+	}
+	if compress {
+		var out io.Writer = clientWriter{c}
+		if c.head {
+			out = io.Discard
+		}
+		if c.debug {
+			out = &countingWriter{Writer: out, n: &c.outBytes}
+		}
+		var sha hash.Hash
+		cached := ""
+		if c.digest && c.fi != nil {
+			if sum, ok := c.sums.lookup(c.sumKey, c.fi); ok {
+				cached = reprDigest(sum)
+			}
+		}
+		if c.digest && !c.head && cached == "" {
+			sha = sha256.New()
+			out = io.MultiWriter(out, sha)
+		}
+		if enc, err := encoders[c.encoding](out, c.level); err == nil {
+			h := c.Header()
+			size := h.Get("Content-Length")
+			h.Set("Content-Encoding", c.encoding)
+			h.Del("Content-Length")
+			h.Del("Repr-Digest")
+			if cached != "" {
+				h.Set("Repr-Digest", cached)
+			} else if sha != nil {
+				c.sha = sha
+				h.Add("Trailer", "Repr-Digest")
+			}
+			c.setEncodedETag()
+			if c.debug {
+				// The compressed length is only known at the end, so it
+				// follows the body as a trailer, which many clients never
+				// show. The uncompressed one goes with the headers when
+				// Content-Length gave it up front.
+				if size != "" {
+					h.Set("X-Uncompressed-Length", size)
+					h.Add("Trailer", "X-Compressed-Length")
+				} else {
+					h.Add("Trailer", "X-Uncompressed-Length, X-Compressed-Length")
+				}
+			}
+			c.w = enc
+		}
+	}
+	if c.w == nil {
+		c.w = identityEncoder{clientWriter{c}}
+		if c.identity != nil && c.code != http.StatusNotModified && c.code != http.StatusNoContent {
+			if d := c.identity(); d != "" {
+				c.Header().Set("Repr-Digest", d)
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+}
+
+func (c *compressResponseWriter) setEncodedETag() {
+	if tag := c.Header().Get("ETag"); tag != "" {
+		c.Header().Set("ETag", etagForEncoding(tag, c.encoding))
+	}
+}
+
+// drain writes out anything buffered before the decision was made.
+func (c *compressResponseWriter) drain() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	buf := c.buf
+	c.buf = nil
+	n, err := c.w.Write(buf)
+	c.inBytes += int64(n)
+	return err
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.code == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.sniffing {
+		if len(c.buf)+len(b) < c.sniffSize {
+			c.buf = append(c.buf, b...)
+			return len(b), nil
+		}
+		c.sniff(b[:c.sniffSize-len(c.buf)])
+	}
+	if c.w == nil {
+		if len(c.buf)+len(b) < c.minSize {
+			c.buf = append(c.buf, b...)
+			return len(b), nil
+		}
+		c.decide(true)
+	}
+	if err := c.drain(); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(b)
+	c.inBytes += int64(n)
+	if c.flushEvery > 0 && c.Header().Get("Content-Encoding") != "" {
+		if c.unflushed += n; c.unflushed >= c.flushEvery {
+			c.Flush()
+		}
+	}
+	return n, err
+}
+
+// Flush pushes any buffered compressed bytes to the client. A flush before
+// the size is known commits to compression, since the caller is streaming.
+func (c *compressResponseWriter) Flush() {
+	if c.err != nil {
+		return
+	}
+	if c.code == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.sniffing {
+		c.sniff(nil)
+	}
+	if c.w == nil {
+		c.decide(true)
+	}
+	if err := c.drain(); err != nil {
+		return
+	}
+	c.unflushed = 0
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response, sending short bodies through uncompressed.
+func (c *compressResponseWriter) Close() error {
+	if c.code == 0 {
+		return nil
+	}
+	defer func() {
+		if c.held {
+			c.held = false
+			c.limit.release()
+		}
+	}()
+	if c.sniffing {
+		c.sniff(nil)
+	}
+	if c.w == nil {
+		// A sniffed body can be held back whole and still reach minSize.
+		c.decide(len(c.buf) >= c.minSize)
+	}
+	err := c.drain()
+	if c.err != nil {
+		// The client is gone, which is not worth reporting. Closing only
+		// returns the encoder to its pool, as clientWriter refuses the
+		// trailer.
+		c.w.Close()
+		return nil
+	}
+	if err != nil {
+		c.w.Close()
+		return err
+	}
+	err = c.w.Close()
+	if c.debug && c.Header().Get("Content-Encoding") != "" {
+		// Only the lengths announced as trailers are sent from here.
+		setLengthHeaders(c.Header(), c.inBytes, c.outBytes)
+	}
+	if c.sha != nil && err == nil && c.err == nil {
+		sum := c.sha.Sum(nil)
+		c.Header().Set("Repr-Digest", reprDigest(sum))
+		if c.fi != nil && c.code == http.StatusOK {
+			c.sums.store(c.sumKey, c.fi, sum)
+		}
+	}
+	return err
+}
+
+// countingWriter adds the number of bytes written through it to *n.
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
+
+// setLengthHeaders reports the sizes of a response whose encoded form was
+// ready in advance, for -debug-headers.
+func setLengthHeaders(h http.Header, uncompressed, compressed int64) {
+	h.Set("X-Uncompressed-Length", strconv.FormatInt(uncompressed, 10))
+	h.Set("X-Compressed-Length", strconv.FormatInt(compressed, 10))
+}
+
+// sidecarExts maps the encodings -precompressed can serve to the file name
+// suffix of their precompressed copies.
+var sidecarExts = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// servePrecompressed serves the best precompressed copy of name in root
+// that the client accepts, trying encs in negotiation order and skipping
+// those with no copy on disk, and reports whether it served one.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, root http.FileSystem, name string, encs []string, opts compressOptions) bool {
+	for len(encs) > 0 {
+		enc := negotiateEncoding(r, encs)
+		if enc == "" {
+			return false
+		}
+		if serveSidecar(w, r, root, name, enc, opts) {
+			return true
+		}
+		encs = slices.DeleteFunc(slices.Clone(encs), func(e string) bool { return e == enc })
+	}
+	return false
+}
+
+// serveSidecar serves the copy of name precompressed with enc from root if
+// one exists, reporting whether it did. The Content-Type follows the
+// original name and conditional requests are checked against its mtime.
+// A copy older than the original is left alone, as being out of date.
+// With opts.Digests set, the Repr-Digest is that of the copy.
+func serveSidecar(w http.ResponseWriter, r *http.Request, root http.FileSystem, name, enc string, opts compressOptions) bool {
+	f, err := root.Open(name + sidecarExts[enc])
+	if err != nil {
+		opts.Metrics.cacheLookup(r.Context(), "sidecar", "miss", 0)
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	// The response carries the original's validators, so a copy older
+	// than the original would be cached as its new content.
+	var ofi fs.FileInfo
+	if orig, err := root.Open(name); err == nil {
+		ofi, _ = orig.Stat()
+		orig.Close()
+	}
+	if ofi != nil && fi.ModTime().Before(ofi.ModTime()) {
+		opts.Metrics.cacheLookup(r.Context(), "sidecar", "miss", 0)
+		return false
+	}
+	if opts.Digests != nil {
+		sum, err := opts.Digests.sum(name+sidecarExts[enc], f, fi)
+		if err != nil {
+			return false
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		w.Header().Set("Repr-Digest", reprDigest(sum))
+	}
+
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Content-Encoding", enc)
+	if tag := w.Header().Get("ETag"); tag != "" {
+		w.Header().Set("ETag", etagForEncoding(tag, enc))
+	}
+	modtime, saved := fi.ModTime(), int64(0)
+	if ofi != nil {
+		modtime, saved = ofi.ModTime(), ofi.Size()-fi.Size()
+		addBodyBytes(r.Context(), ofi.Size())
+		if opts.Debug {
+			setLengthHeaders(w.Header(), ofi.Size(), fi.Size())
+		}
+	}
+	opts.Metrics.cacheLookup(r.Context(), "sidecar", "hit", saved)
+	http.ServeContent(w, r, name, modtime, f)
+	return true
+}
+
+// serveCached serves the file at the request path from the encoded cache,
+// compressing and storing it on a miss, and reports whether it did. Files
+// outside the cache's size bounds are left to the caller. busy reports a
+// miss that was left because opts.Limit had no slot free, so the caller
+// should not try compressing the file either.
+func serveCached(w http.ResponseWriter, r *http.Request, root http.FileSystem, opts compressOptions, enc string) (served, busy bool) {
+	name := r.URL.Path
+	f, err := root.Open(name)
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() || fi.Size() < int64(opts.MinSize) || fi.Size() > opts.Cache.maxFile {
+		return false, false
+	}
+
+	k := encodedKey{name, enc}
+	e, ok := opts.Cache.get(k, fi.ModTime(), fi.Size())
+	if ok {
+		opts.Metrics.cacheLookup(r.Context(), "cache", "hit", e.size-int64(len(e.data)))
+	} else {
+		opts.Metrics.cacheLookup(r.Context(), "cache", "miss", 0)
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return false, false
+		}
+		ctype := mime.TypeByExtension(filepath.Ext(name))
+		if ctype == "" {
+			ctype = http.DetectContentType(data)
+		}
+		if mediaTypeRank(ctype, opts.DenyTypes) == exactMatch {
+			return false, false
+		}
+		if !opts.Limit.acquire(r.Context()) {
+			return false, true
+		}
+		z, err := encode(enc, opts.level(filepath.Ext(name)), data)
+		opts.Limit.release()
+		if err != nil {
+			return false, false
+		}
+		e = &encodedEntry{key: k, mod: fi.ModTime(), size: fi.Size(), ctype: ctype, data: z}
+		if opts.Digests != nil {
+			sum := sha256.Sum256(z)
+			e.digest = reprDigest(sum[:])
+		}
+		opts.Cache.put(e)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", e.ctype)
+	h.Set("Content-Encoding", enc)
+	if tag := h.Get("ETag"); tag != "" {
+		h.Set("ETag", etagForEncoding(tag, enc))
+	}
+	// ServeContent leaves out Content-Length on encoded bodies, but here the
+	// length is known up front.
+	h.Set("Content-Length", strconv.Itoa(len(e.data)))
+	if e.digest != "" {
+		h.Set("Repr-Digest", e.digest)
+	}
+	if opts.Debug {
+		setLengthHeaders(h, e.size, int64(len(e.data)))
+	}
+	addBodyBytes(r.Context(), e.size)
+	http.ServeContent(w, r, name, e.mod, bytes.NewReader(e.data))
+	return true, false
+}
+
+// Ranks returned by mediaTypeRank.
+const (
+	noMatch       = iota
+	wildcardMatch // by a pattern such as text/*
+	exactMatch
+)
+
+// mediaTypeRank reports how closely the media type of the Content-Type ct
+// matches patterns: exactly, through a pattern such as text/* that covers a
+// whole top-level type, or not at all.
+func mediaTypeRank(ct string, patterns []string) int {
+	mt, _, _ := strings.Cut(ct, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	if mt == "" {
+		return noMatch
+	}
+	rank := noMatch
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(mt, prefix+"/") {
+				rank = wildcardMatch
+			}
+		} else if mt == p {
+			return exactMatch
+		}
+	}
+	return rank
+}
+
+// compressOptions configures withCompression.
+type compressOptions struct {
+	Encodings []string // allowed encodings in preference order
+	Exts      []string // compressible extensions, lowercase with the dot
+	Types     []string // compressible media types for other paths
+	GzipLevel int      // gzip compression level, 1-9
+	MinSize   int      // bodies shorter than this are sent uncompressed
+	FlushSize int      // input bytes between encoder flushes; 0 never
+	SniffSize int      // most body bytes held to sniff a missing type
+	Debug     bool     // report body sizes in X-*-Length headers
+
+	// ExtLevels overrides GzipLevel for the extensions it holds.
+	ExtLevels map[string]int
+
+	// Precompressed lists the encodings whose copies on disk, such as
+	// registry.tsv.br, are served in place of compressing on the fly.
+	Precompressed []string
+
+	// DenyExts and DenyTypes name content that is already compressed and
+	// must pass through as is. They override Exts and Types, except that an
+	// exact entry in Exts or Types wins over a wildcard in DenyTypes.
+	DenyExts  []string
+	DenyTypes []string
+
+	// Cache, when set, keeps compressed copies of files in memory.
+	Cache *encodedCache
+
+	// Limit, when set, bounds the compressions running at once.
+	Limit *encodeLimit
+
+	// Digests, when set, has every response carry a Repr-Digest of the
+	// bytes sent; see withDigest. It caches the sums of sidecar files.
+	Digests *sumCache
+
+	// Metrics, when set, counts the hits and misses of Cache and of the
+	// sidecar lookups for Precompressed.
+	Metrics *metrics
+}
+
+// level returns the gzip and deflate level for files with extension ext.
+func (o compressOptions) level(ext string) int {
+	if n, ok := o.ExtLevels[strings.ToLower(ext)]; ok {
+		return n
+	}
+	return o.GzipLevel
+}
+
+// dirTypes are the media types compressed for directory paths when no
+// others are configured.
+var dirTypes = []string{"text/html"}
+
+// hasVariants reports whether name is compressed by its extension, so that
+// its responses vary on Accept-Encoding whatever the client sends.
+func (o compressOptions) hasVariants(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return slices.Contains(o.Exts, ext) && !slices.Contains(o.DenyExts, ext)
+}
+
+func withCompression(opts compressOptions, root http.FileSystem, next http.Handler) http.Handler {
+	prefs := opts.Encodings
+	var precompressed []string
+	for _, enc := range prefs {
+		if slices.Contains(opts.Precompressed, enc) {
+			precompressed = append(precompressed, enc)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The extension is a cheap first check. For paths that fail it, the
+		// decision waits for the Content-Type of the response.
+		ext := strings.ToLower(filepath.Ext(r.URL.Path))
+		byExt := slices.Contains(opts.Exts, ext)
+		types := opts.Types
+		if len(types) == 0 && strings.HasSuffix(r.URL.Path, "/") {
+			// A directory has no extension to go by, but its index page
+			// or generated listing is HTML.
+			types = dirTypes
+		}
+		if slices.Contains(opts.DenyExts, ext) || !byExt && len(types) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Whether or not this response ends up compressed, the resource has
+		// encoded variants, so caches must key on Accept-Encoding.
+		if byExt {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+
+		// Byte ranges refer to the identity representation, so let the file
+		// server answer them uncompressed.
+		enc := ""
+		if r.Header.Get("Range") == "" {
+			enc = negotiateEncoding(r, prefs)
+		}
+		if enc == "" && byExt {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Sidecars and cached copies take their Content-Type from the
+		// extension, so they are only for paths that passed on it.
+		if byExt && servePrecompressed(w, r, root, r.URL.Path, precompressed, opts) {
+			return
+		}
+		if byExt && opts.Cache != nil {
+			served, busy := serveCached(w, r, root, opts, enc)
+			if served {
+				return
+			}
+			if busy {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			encoding:       enc,
+			level:          opts.level(ext),
+			minSize:        opts.MinSize,
+			flushEvery:     opts.FlushSize,
+			sniffSize:      opts.SniffSize,
+			debug:          opts.Debug,
+			deny:           opts.DenyTypes,
+			head:           r.Method == http.MethodHead,
+			digest:         opts.Digests != nil,
+			limit:          opts.Limit,
+			ctx:            r.Context(),
+		}
+		if !byExt {
+			cw.types = types
+		}
+		defer cw.Close()
+
+		// The file server only knows the identity ETag, so strip the encoding
+		// suffix from If-None-Match to let it match a cached encoded copy.
+		suffix := "-" + enc + `"`
+		if inm := r.Header.Get("If-None-Match"); enc != "" && strings.Contains(inm, suffix) {
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, suffix, `"`))
+			cw.matchedEncodedETag = true
+		}
+
+		if opts.Digests != nil && enc != "" {
+			// Only cw knows whether the body is compressed, and with it
+			// which digest applies, so withDigest leaves the digest to it.
+			r = r.WithContext(context.WithValue(r.Context(), digestDeferredKey{}, true))
+			name := r.URL.Path
+			cw.sums = opts.Digests
+			cw.identity = func() string { return fileDigest(root, opts.Digests, name) }
+			if f, err := root.Open(name); err == nil {
+				if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+					cw.fi = fi
+					cw.sumKey = fmt.Sprintf("%s\x00%s\x00%d", name, enc, cw.level)
+				}
+				f.Close()
+			}
+		}
+
+		next.ServeHTTP(cw, r)
+	})
+}
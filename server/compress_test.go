@@ -0,0 +1,344 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRegistry returns a registry file of n rows, well over the minimum
+// size for compression once n is in the tens.
+func testRegistry(n int) string {
+	var b strings.Builder
+	b.WriteString("#v=0123456789abcdef\nslug\ttitle\turl\ttags\n")
+	for i := range n {
+		fmt.Fprintf(&b, "demo-%d\tDemo %d\thttps://example.com/demo-%d/\ttools,css\n", i, i, i)
+	}
+	return b.String()
+}
+
+// gunzip returns the decompressed body, failing t if it is not gzip.
+func gunzip(t *testing.T, body io.Reader) string {
+	t.Helper()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressedContentLength(t *testing.T) {
+	registry := testRegistry(200)
+	for _, tt := range []struct {
+		name      string
+		configure func(*Config)
+		length    bool // whether the encoded length is known up front
+	}{
+		{"on the fly", nil, false},
+		{"cached", func(c *Config) { c.CacheSize = 1 << 20 }, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, map[string]string{"registry.tsv": registry}, tt.configure)
+			w := get(h, "/registry.tsv", "Accept-Encoding", "gzip")
+			if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("status %d, Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+			}
+			cl, ok := w.Header()["Content-Length"]
+			if ok != tt.length {
+				t.Fatalf("Content-Length %v, want one: %v", cl, tt.length)
+			}
+			if ok && cl[0] != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length %s, body is %d bytes", cl[0], w.Body.Len())
+			}
+			if got := gunzip(t, w.Body); got != registry {
+				t.Errorf("body decompresses to %d bytes, want %d", len(got), len(registry))
+			}
+		})
+	}
+}
+
+// BenchmarkGzipWriter compares writers from gzipPools with a new one per
+// response; run with -benchmem to see the allocations the pool saves.
+func BenchmarkGzipWriter(b *testing.B) {
+	body := []byte(testRegistry(200))
+	for _, bm := range []struct {
+		name string
+		newW func(w io.Writer) (encoder, error)
+	}{
+		{"pooled", func(w io.Writer) (encoder, error) { return newPooledGzipWriter(w, 6) }},
+		{"new", func(w io.Writer) (encoder, error) { return gzip.NewWriterLevel(w, 6) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for range b.N {
+				zw, err := bm.newW(io.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				zw.Write(body)
+				zw.Close()
+			}
+		})
+	}
+}
+
+func TestRangeNotCompressed(t *testing.T) {
+	registry := testRegistry(200)
+	h := newTestHandler(t, map[string]string{"registry.tsv": registry}, nil)
+	w := get(h, "/registry.tsv", "Accept-Encoding", "gzip", "Range", "bytes=0-99")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding %q on a range", ce)
+	}
+	if got := w.Body.String(); got != registry[:100] {
+		t.Errorf("body %q, want the first 100 bytes", got)
+	}
+}
+
+func TestNotModifiedNotCompressed(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"registry.tsv": testRegistry(200)}, nil)
+	first := get(h, "/registry.tsv", "Accept-Encoding", "gzip")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status %d", first.Code)
+	}
+	for _, cond := range [][2]string{
+		{"If-None-Match", first.Header().Get("ETag")},
+		{"If-Modified-Since", first.Header().Get("Last-Modified")},
+	} {
+		if cond[1] == "" {
+			t.Fatalf("first response has no %s validator", cond[0])
+		}
+		w := get(h, "/registry.tsv", "Accept-Encoding", "gzip", cond[0], cond[1])
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s: status %d, want %d", cond[0], w.Code, http.StatusNotModified)
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%s: Content-Encoding %q on a 304", cond[0], ce)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: 304 has a %d byte body", cond[0], w.Body.Len())
+		}
+	}
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"gzip;q=0", map[string]float64{"gzip": 0}},
+		{"gzip;q=0.5, br", map[string]float64{"gzip": 0.5, "br": 1}},
+		{"identity;q=1, gzip;q=0", map[string]float64{"identity": 1, "gzip": 0}},
+	} {
+		if got := parseAcceptEncoding(tt.header); !maps.Equal(got, tt.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		prefs  []string
+		want   string
+	}{
+		{"gzip;q=0", []string{"br", "gzip", "deflate"}, ""},
+		{"gzip;q=0.5, br", []string{"br", "gzip", "deflate"}, "br"},
+		{"gzip;q=0.5, br", []string{"gzip"}, "gzip"},
+		{"identity;q=1, gzip;q=0", []string{"br", "gzip", "deflate"}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := negotiateEncoding(r, tt.prefs); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %v) = %q, want %q", tt.header, tt.prefs, got, tt.want)
+		}
+	}
+}
+
+func TestVaryWithoutAcceptEncoding(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"app.js": strings.Repeat("console.log(1);\n", 200)}, nil)
+	w := get(h, "/app.js")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Content-Encoding %q without Accept-Encoding", ce)
+	}
+	if !slices.Contains(w.Header().Values("Vary"), "Accept-Encoding") {
+		t.Errorf("Vary %q, want Accept-Encoding", w.Header().Values("Vary"))
+	}
+}
+
+// goneWriter is a connection whose client leaves once ctx is done: every
+// write after that fails, and is counted.
+type goneWriter struct {
+	*httptest.ResponseRecorder
+	ctx   context.Context
+	after int // writes attempted once gone
+}
+
+func (g *goneWriter) Write(b []byte) (int, error) {
+	if err := g.ctx.Err(); err != nil {
+		g.after++
+		return 0, err
+	}
+	return g.ResponseRecorder.Write(b)
+}
+
+func TestCompressClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunk := []byte(testRegistry(50))
+	failed := -1
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		rc := http.NewResponseController(w)
+		for i := range 100 {
+			if i == 10 {
+				cancel()
+			}
+			if _, err := w.Write(chunk); err != nil {
+				failed = i
+				return
+			}
+			rc.Flush()
+		}
+	})
+	limit := newEncodeLimit(1, 0)
+	opts := compressOptions{Encodings: []string{"gzip"}, Exts: []string{".tsv"}, GzipLevel: 6, MinSize: 1400, Limit: limit}
+	h := withCompression(opts, http.Dir(t.TempDir()), next)
+
+	w := &goneWriter{ResponseRecorder: httptest.NewRecorder(), ctx: ctx}
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/big.tsv", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	if failed < 10 {
+		t.Fatalf("handler saw its first write error at chunk %d, want once the client left at 10", failed)
+	}
+	if w.after != 1 {
+		t.Errorf("%d writes reached the connection after it failed, want only the one that failed", w.after)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+	if !limit.acquire(context.Background()) {
+		t.Error("compression slot not released")
+	}
+}
+
+// BenchmarkGzipLevels measures the CPU each gzip level costs on a registry
+// of a typical size, alongside the compressed size it buys, to help pick
+// -gzip-ext-level values.
+func BenchmarkGzipLevels(b *testing.B) {
+	body := []byte(testRegistry(2000))
+	for level := gzip.BestSpeed; level <= gzip.BestCompression; level++ {
+		b.Run(strconv.Itoa(level), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			var out int64
+			for range b.N {
+				cw := &countingWriter{Writer: io.Discard, n: &out}
+				zw, err := newPooledGzipWriter(cw, level)
+				if err != nil {
+					b.Fatal(err)
+				}
+				zw.Write(body)
+				zw.Close()
+			}
+			b.ReportMetric(float64(out)/float64(b.N)/float64(len(body)), "ratio")
+		})
+	}
+}
+
+func TestSniffLargeFirstWrite(t *testing.T) {
+	const sniffSize = 512
+	body := []byte(strings.Repeat("plain text with no declared type\n", 256<<10)) // 8 MiB
+	var held int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+		held = cap(w.(*compressResponseWriter).buf)
+	})
+	opts := compressOptions{Encodings: []string{"gzip"}, Types: []string{"text/plain"}, GzipLevel: 1, MinSize: 1400, SniffSize: sniffSize}
+	h := withCompression(opts, http.Dir(t.TempDir()), next)
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/notes", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(w, r)
+		return w
+	}
+	serve() // warm the writer pool
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w := serve()
+	runtime.ReadMemStats(&after)
+
+	if held > sniffSize {
+		t.Errorf("sniff buffer grew to %d bytes, cap is %d", held, sniffSize)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(body)/8) {
+		t.Errorf("serving an %d byte body allocated %d bytes", len(body), alloc)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q, want the sniffed text/plain", ct)
+	}
+	if got := gunzip(t, w.Body); got != string(body) {
+		t.Errorf("body decompresses to %d bytes, want %d", len(got), len(body))
+	}
+}
+
+func TestStaleSidecarSkipped(t *testing.T) {
+	registry, old := testRegistry(200), testRegistry(100)
+	var z strings.Builder
+	zw := gzip.NewWriter(&z)
+	zw.Write([]byte(old))
+	zw.Close()
+
+	for _, tt := range []struct {
+		name string
+		age  time.Duration // of the sidecar relative to the original
+		want string
+	}{
+		{"fresh", time.Minute, old},
+		{"stale", -time.Minute, registry},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, map[string]string{"registry.tsv": registry, "registry.tsv.gz": z.String()}, func(c *Config) {
+				now := time.Now()
+				if err := os.Chtimes(filepath.Join(c.Dir, "registry.tsv"), now, now); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(filepath.Join(c.Dir, "registry.tsv.gz"), now, now.Add(tt.age)); err != nil {
+					t.Fatal(err)
+				}
+			})
+			w := get(h, "/registry.tsv", "Accept-Encoding", "gzip")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if got := gunzip(t, w.Body); got != tt.want {
+				t.Errorf("served %d bytes of content, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every server setting. Each field can be set on the command
+// line or in the YAML (or JSON) file named by -config. A file key is the
+// flag name without its leading dash, e.g. gzip-level: speed for
+// -gzip-level=speed, and flags given on the command line override the file.
+type Config struct {
+	Dir             string        `yaml:"dir"`
+	Mounts          mountList     `yaml:"mount"`
+	Embedded        bool          `yaml:"embedded"`
+	Addr            listValue     `yaml:"addr"`
+	AdminAddr       string        `yaml:"admin-addr"`
+	SocketMode      fileMode      `yaml:"socket-mode"`
+	User            string        `yaml:"user"`
+	Group           string        `yaml:"group"`
+	Compression     listValue     `yaml:"compression"`
+	Precompressed   listValue     `yaml:"precompressed"`
+	GzipMinSize     int           `yaml:"gzip-min-size"`
+	GzipFlushSize   int           `yaml:"gzip-flush-size"`
+	GzipSniffSize   int           `yaml:"gzip-sniff-size"`
+	GzipConcurrency int           `yaml:"gzip-concurrency"`
+	GzipWait        time.Duration `yaml:"gzip-concurrency-wait"`
+	DebugHeaders    bool          `yaml:"debug-headers"`
+	GzipLevel       gzipLevel     `yaml:"gzip-level"`
+	GzipExtLevel    multiValue    `yaml:"gzip-ext-level"`
+	GzipExt         listValue     `yaml:"gzip-ext"`
+	GzipTypes       listValue     `yaml:"gzip-types"`
+	GzipDeny        listValue     `yaml:"gzip-deny"`
+	CacheSize       int64         `yaml:"cache-size"`
+	CacheMaxFile    int64         `yaml:"cache-max-file"`
+	TLSCert         string        `yaml:"tls-cert"`
+	TLSKey          string        `yaml:"tls-key"`
+	RedirectAddr    string        `yaml:"redirect-addr"`
+	AutocertDomains listValue     `yaml:"autocert-domains"`
+	AutocertCache   string        `yaml:"autocert-cache"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	ReadTimeout     time.Duration `yaml:"read-timeout"`
+	WriteTimeout    time.Duration `yaml:"write-timeout"`
+	IdleTimeout     time.Duration `yaml:"idle-timeout"`
+	RequestTimeout  time.Duration `yaml:"request-timeout"`
+	StaticTimeout   time.Duration `yaml:"static-timeout"`
+	MaxConns        int           `yaml:"max-conns"`
+	MaxConnsMode    string        `yaml:"max-conns-mode"`
+	AccessLog       bool          `yaml:"access-log"`
+	LogFormat       string        `yaml:"log-format"`
+	ErrorFormat     string        `yaml:"error-format"`
+	LogSkip         listValue     `yaml:"access-log-skip"`
+	LogCache        bool          `yaml:"access-log-cache"`
+	LogFile         string        `yaml:"log-file"`
+	CORS            bool          `yaml:"cors"`
+	CORSOrigins     listValue     `yaml:"cors-origins"`
+	CORSMethods     listValue     `yaml:"cors-methods"`
+	CORSHeaders     listValue     `yaml:"cors-headers"`
+	CORSExpose      listValue     `yaml:"cors-expose-headers"`
+	CORSMaxAge      time.Duration `yaml:"cors-max-age"`
+	CORSCredentials bool          `yaml:"cors-credentials"`
+	SPAFallback     bool          `yaml:"spa-fallback"`
+	SPABypass       listValue     `yaml:"spa-bypass"`
+	NotFoundPage    string        `yaml:"notfound-page"`
+	DefaultType     string        `yaml:"default-content-type"`
+	NoExtType       string        `yaml:"extensionless-type"`
+	Robots          string        `yaml:"robots"`
+	Favicon         string        `yaml:"favicon"`
+	NoDirListing    bool          `yaml:"no-dir-listing"`
+	AutoIndex       bool          `yaml:"auto-index"`
+	IndexFiles      listValue     `yaml:"index-files"`
+	Dotfiles        bool          `yaml:"dotfiles"`
+	FollowSymlinks  bool          `yaml:"follow-symlinks"`
+	AtomicReads     bool          `yaml:"atomic-reads"`
+	MaxFileSize     int64         `yaml:"max-file-size"`
+	RateLimit       float64       `yaml:"rate-limit"`
+	RateBurst       int           `yaml:"rate-burst"`
+	TrustedProxies  listValue     `yaml:"trusted-proxies"`
+	CSP             string        `yaml:"csp"`
+	DynamicCache    string        `yaml:"dynamic-cache-control"`
+	RegistryMaxAge  time.Duration `yaml:"registry-max-age"`
+	StaleRevalidate time.Duration `yaml:"registry-stale-while-revalidate"`
+	StaleIfError    time.Duration `yaml:"registry-stale-if-error"`
+	HealthPath      string        `yaml:"health-path"`
+	MetricsPath     string        `yaml:"metrics-path"`
+	VersionPath     string        `yaml:"version-path"`
+	Pprof           bool          `yaml:"pprof"`
+	BasicAuth       string        `yaml:"basic-auth"`
+	BasicAuthFile   string        `yaml:"basic-auth-file"`
+	IndexPath       string        `yaml:"index-path"`
+	IndexTTL        time.Duration `yaml:"index-ttl"`
+	EventsPath      string        `yaml:"events-path"`
+	SnapshotAlias   bool          `yaml:"snapshot-alias"`
+	JSONPath        string        `yaml:"json-path"`
+	RaggedRows      string        `yaml:"ragged-rows"`
+	JSONMaxLimit    int           `yaml:"json-max-limit"`
+	MetaPath        string        `yaml:"meta-path"`
+	DiffPath        string        `yaml:"diff-path"`
+	Checksums       bool          `yaml:"checksums"`
+	DigestHeader    bool          `yaml:"digest-header"`
+	DiffKey         string        `yaml:"diff-key"`
+	DiffMaxSize     int64         `yaml:"diff-max-size"`
+	Validate        string        `yaml:"validate"`
+	MIME            multiValue    `yaml:"mime"`
+	MIMEFile        string        `yaml:"mime-file"`
+
+	// CacheRules can only be set from the config file, as a list of
+	// {pattern, cache-control} mappings evaluated in order.
+	CacheRules []cacheRule `yaml:"cache-rules"`
+
+	trustedProxies []netip.Prefix // parsed TrustedProxies
+	gzipDenyExts   []string       // extensions in GzipDeny
+	gzipDenyTypes  []string       // media types in GzipDeny
+	gzipExtLevels  map[string]int // parsed GzipExtLevel
+	cacheRules     []cacheRule    // CacheRules, then the registry rule
+}
+
+func defaultConfig() Config {
+	return Config{
+		Dir:             "../dist",
+		Addr:            listValue{"127.0.0.1:8787"},
+		SocketMode:      0o660,
+		Compression:     listValue{"br", "gzip", "deflate"},
+		Precompressed:   listValue{"gzip"},
+		GzipMinSize:     1400,
+		GzipFlushSize:   256 << 10,
+		GzipSniffSize:   512,
+		GzipLevel:       9,
+		GzipExt:         listValue{".tsv", ".json", ".html", ".js", ".css"},
+		GzipTypes:       listValue{"text/*", "application/json", "application/javascript", "image/svg+xml"},
+		GzipDeny:        listValue{".gz", ".br", ".zip", ".png", ".jpg", ".jpeg", ".gif", ".webp", ".woff2", "image/*", "font/woff2", "application/gzip", "application/zip"},
+		CacheMaxFile:    1 << 20,
+		AutocertCache:   "autocert-cache",
+		ShutdownTimeout: 15 * time.Second,
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		RequestTimeout:  10 * time.Second,
+		MaxConnsMode:    "queue",
+		AccessLog:       true,
+		LogFormat:       "text",
+		ErrorFormat:     "text",
+		CORS:            true,
+		CORSOrigins:     listValue{"*"},
+		CORSMethods:     listValue{"GET", "HEAD"},
+		CORSHeaders:     listValue{"*"},
+		CORSExpose:      listValue{"X-Total-Count", "Link"},
+		CORSMaxAge:      10 * time.Minute,
+		SPABypass:       listValue{"/api/", "/registry"},
+		NoDirListing:    true,
+		IndexFiles:      listValue{"index.html"},
+		FollowSymlinks:  true,
+		RateBurst:       20,
+		HealthPath:      "/healthz",
+		MetricsPath:     "/metrics",
+		VersionPath:     "/version",
+		IndexPath:       "/index.json",
+		IndexTTL:        10 * time.Second,
+		EventsPath:      "/events",
+		SnapshotAlias:   true,
+		JSONPath:        "/registry.json",
+		RaggedRows:      "pad",
+		JSONMaxLimit:    1000,
+		MetaPath:        "/registry.meta.json",
+		DiffPath:        "/diff",
+		Checksums:       true,
+		DiffMaxSize:     8 << 20,
+		Validate:        "off",
+		DynamicCache:    "no-store",
+		RegistryMaxAge:  time.Minute,
+		CacheRules:      slices.Clone(defaultCacheRules),
+	}
+}
+
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Dir, "dir", c.Dir, "directory to serve at / unless a -mount claims it")
+	fs.Var(&c.Mounts, "mount", "serve a directory under a path prefix, as prefix=dir; repeatable")
+	fs.BoolVar(&c.Embedded, "embedded", c.Embedded, "serve / from the files embedded at build time (requires -tags embed)")
+	fs.Var(&c.Addr, "addr", "comma-separated listen addresses, host:port or unix:/path/to/sock, e.g. 0.0.0.0:8787,[::]:8787")
+	fs.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "separate listen address for the health, metrics and pprof endpoints, which then leave the main address")
+	fs.Var(&c.SocketMode, "socket-mode", "permissions of the Unix socket when -addr is unix:/path, in octal")
+	fs.StringVar(&c.User, "user", c.User, "user name or uid to switch to once the listeners are bound (Linux only)")
+	fs.StringVar(&c.Group, "group", c.Group, "group name or gid to switch to with -user; defaults to the user's primary group, and is required for a uid with no passwd entry")
+	fs.Var(&c.Compression, "compression", "allowed content encodings in preference order")
+	fs.Var(&c.Precompressed, "precompressed", "comma-separated encodings, br and gzip, whose .br or .gz copies next to a file are served instead of compressing it")
+	fs.IntVar(&c.GzipMinSize, "gzip-min-size", c.GzipMinSize, "smallest response body worth compressing, in bytes")
+	fs.IntVar(&c.GzipFlushSize, "gzip-flush-size", c.GzipFlushSize, "flush compressed output to the client after this many bytes of a large body; 0 never flushes early")
+	fs.IntVar(&c.GzipSniffSize, "gzip-sniff-size", c.GzipSniffSize, "most bytes held back to sniff the type of a response that has no Content-Type; 0 sends such responses uncompressed")
+	fs.IntVar(&c.GzipConcurrency, "gzip-concurrency", c.GzipConcurrency, "most responses compressed at once; others go out uncompressed; 0 for no limit")
+	fs.DurationVar(&c.GzipWait, "gzip-concurrency-wait", c.GzipWait, "how long a response waits for one of the -gzip-concurrency slots before going out uncompressed; 0 never waits")
+	fs.BoolVar(&c.DebugHeaders, "debug-headers", c.DebugHeaders, "report body sizes before and after compression in X-Uncompressed-Length and X-Compressed-Length, the latter as a trailer when compressing on the fly; reveals size information")
+	fs.Var(&c.GzipLevel, "gzip-level", "gzip compression level: 1-9, best, speed or default")
+	fs.Var(&c.GzipExtLevel, "gzip-ext-level", "gzip level for one extension in place of -gzip-level, as .ext=level, e.g. .html=speed; repeatable")
+	fs.Var(&c.GzipExt, "gzip-ext", "comma-separated file extensions to compress, with or without the leading dot")
+	fs.Var(&c.GzipTypes, "gzip-types", "comma-separated Content-Types, such as text/*, compressed when the extension is not in -gzip-ext; empty to go by extension only")
+	fs.Var(&c.GzipDeny, "gzip-deny", "comma-separated extensions (.png) and Content-Types (image/*) that are already compressed and never recompressed")
+	fs.Int64Var(&c.CacheSize, "cache-size", c.CacheSize, "bytes of memory per mount for caching compressed files; 0 disables the cache")
+	fs.Int64Var(&c.CacheMaxFile, "cache-max-file", c.CacheMaxFile, "largest file, in bytes, kept in the compressed cache")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file; enables HTTPS together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file; enables HTTPS together with -tls-cert")
+	fs.StringVar(&c.RedirectAddr, "redirect-addr", c.RedirectAddr, "with -tls-cert, also listen here, e.g. :80, and redirect all plain HTTP requests to HTTPS")
+	fs.Var(&c.AutocertDomains, "autocert-domains", "comma-separated domains to obtain Let's Encrypt certificates for")
+	fs.StringVar(&c.AutocertCache, "autocert-cache", c.AutocertCache, "directory for cached Let's Encrypt certificates")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "maximum time to read a request, headers included; 0 disables")
+	// WriteTimeout bounds the whole response, so it also caps how long a slow
+	// client may take to download a large file. Raise it, or use 0, when
+	// serving big registries over slow links.
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "maximum time to write a response, including the whole body of large downloads; 0 disables")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long an idle keep-alive connection stays open; 0 disables")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "maximum time for a generated response such as -json-path, answered with 503 when exceeded; 0 disables")
+	fs.DurationVar(&c.StaticTimeout, "static-timeout", c.StaticTimeout, "maximum time to write a file response, in place of -write-timeout; 0 keeps -write-timeout")
+	fs.IntVar(&c.MaxConns, "max-conns", c.MaxConns, "most connections (queue mode) or requests (reject mode) served at once on -addr; 0 for no limit")
+	fs.StringVar(&c.MaxConnsMode, "max-conns-mode", c.MaxConnsMode, "what happens past -max-conns: queue new connections, or reject requests with 503")
+	fs.BoolVar(&c.AccessLog, "access-log", c.AccessLog, "log every request")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "access log format: text or json")
+	fs.StringVar(&c.ErrorFormat, "error-format", c.ErrorFormat, "body of error responses from generated endpoints and middleware: text or json; the file server's own errors stay text")
+	fs.Var(&c.LogSkip, "access-log-skip", "comma-separated paths, such as /favicon.ico, left out of the access log")
+	fs.BoolVar(&c.LogCache, "access-log-cache", c.LogCache, "add whether a compressed copy came from the cache or a sidecar, or missed, to the encoding field of json access logs")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "append logs to this file instead of stderr; it is reopened on SIGHUP for logrotate")
+	fs.BoolVar(&c.CORS, "cors", c.CORS, "send CORS headers and answer preflight requests; -cors=false leaves every CORS header out, as for a same-origin deployment")
+	fs.Var(&c.CORSOrigins, "cors-origins", "comma-separated allowed CORS origins, or * for any")
+	fs.Var(&c.CORSMethods, "cors-methods", "comma-separated methods allowed by CORS preflight responses")
+	fs.Var(&c.CORSHeaders, "cors-headers", "comma-separated request headers allowed by CORS preflight responses")
+	fs.Var(&c.CORSExpose, "cors-expose-headers", "comma-separated response headers that cross-origin scripts may read")
+	fs.DurationVar(&c.CORSMaxAge, "cors-max-age", c.CORSMaxAge, "how long browsers may cache a CORS preflight result")
+	fs.BoolVar(&c.CORSCredentials, "cors-credentials", c.CORSCredentials, "allow cross-origin requests with cookies or credentials; needs explicit -cors-origins")
+	fs.BoolVar(&c.SPAFallback, "spa-fallback", c.SPAFallback, "serve index.html for unknown extensionless paths")
+	fs.Var(&c.SPABypass, "spa-bypass", "comma-separated path prefixes excluded from -spa-fallback")
+	fs.StringVar(&c.NotFoundPage, "notfound-page", c.NotFoundPage, "HTML file served as the body of 404 responses")
+	fs.StringVar(&c.DefaultType, "default-content-type", c.DefaultType, "Content-Type for files otherwise served as application/octet-stream, e.g. text/plain; charset=utf-8")
+	fs.StringVar(&c.NoExtType, "extensionless-type", c.NoExtType, "Content-Type forced on every file whose name has no extension")
+	fs.StringVar(&c.Robots, "robots", c.Robots, "file served as /robots.txt when the directory has none, or off; by default all crawling is disallowed")
+	fs.StringVar(&c.Favicon, "favicon", c.Favicon, "file served as /favicon.ico when the directory has none, or off; by default a built-in icon")
+	fs.Var(&c.IndexFiles, "index-files", "comma-separated file names tried in order as the index of a directory")
+	fs.BoolVar(&c.NoDirListing, "no-dir-listing", c.NoDirListing, "answer 404 for directories without an index.html instead of listing them")
+	fs.BoolVar(&c.AutoIndex, "auto-index", c.AutoIndex, "at / without an index.html, serve a generated page linking the registry files")
+	fs.BoolVar(&c.Dotfiles, "dotfiles", c.Dotfiles, "serve paths with a segment beginning with a dot")
+	fs.Int64Var(&c.MaxFileSize, "max-file-size", c.MaxFileSize, "largest file, in bytes, that is served; larger ones get 403. 0 means no limit")
+	fs.BoolVar(&c.FollowSymlinks, "follow-symlinks", c.FollowSymlinks, "follow symlinks that lead outside the served directory; links within it are always followed")
+	fs.BoolVar(&c.AtomicReads, "atomic-reads", c.AtomicReads, "check that each file does not change while it is read, cutting the response short or answering 503 if it does; not needed when files are published by renaming them into place")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "requests per second allowed per client IP; 0 disables rate limiting")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "requests a client may burst above -rate-limit")
+	fs.StringVar(&c.CSP, "csp", c.CSP, "Content-Security-Policy for HTML responses")
+	fs.StringVar(&c.DynamicCache, "dynamic-cache-control", c.DynamicCache, "Cache-Control for generated responses such as -json-path and -index-path, in place of cache-rules")
+	fs.DurationVar(&c.RegistryMaxAge, "registry-max-age", c.RegistryMaxAge, "max-age of /registry.tsv where no cache-rules entry matches it")
+	fs.DurationVar(&c.StaleRevalidate, "registry-stale-while-revalidate", c.StaleRevalidate, "stale-while-revalidate of /registry.tsv, for CDNs that refresh in the background; 0 leaves it out")
+	fs.DurationVar(&c.StaleIfError, "registry-stale-if-error", c.StaleIfError, "stale-if-error of /registry.tsv, for CDNs that serve a stale copy while the origin fails; 0 leaves it out")
+	fs.StringVar(&c.HealthPath, "health-path", c.HealthPath, "path of the liveness endpoint; empty disables it")
+	fs.StringVar(&c.MetricsPath, "metrics-path", c.MetricsPath, "path of the Prometheus metrics endpoint; empty disables it")
+	fs.StringVar(&c.VersionPath, "version-path", c.VersionPath, "path of the build version endpoint; empty disables it")
+	fs.BoolVar(&c.Pprof, "pprof", c.Pprof, "serve runtime profiles under /debug/pprof/")
+	fs.StringVar(&c.BasicAuth, "basic-auth", c.BasicAuth, "require HTTP Basic credentials, given as user:pass")
+	fs.StringVar(&c.BasicAuthFile, "basic-auth-file", c.BasicAuthFile, "require HTTP Basic credentials from an htpasswd file of bcrypt hashes")
+	fs.StringVar(&c.IndexPath, "index-path", c.IndexPath, "path of the JSON listing of registry files; empty disables it")
+	fs.DurationVar(&c.IndexTTL, "index-ttl", c.IndexTTL, "how long the registry file listing is cached")
+	fs.StringVar(&c.EventsPath, "events-path", c.EventsPath, "path of the server-sent event stream of registry.tsv changes; empty disables it")
+	fs.BoolVar(&c.SnapshotAlias, "snapshot-alias", c.SnapshotAlias, "serve registry.tsv under its content hash as /registry.<hash>.tsv, with the hash at /registry.current")
+	fs.StringVar(&c.JSONPath, "json-path", c.JSONPath, "path of registry.tsv converted to a JSON array of objects; empty disables it")
+	fs.StringVar(&c.RaggedRows, "ragged-rows", c.RaggedRows, "how the JSON conversion treats rows whose cell count differs from the header: pad or error")
+	fs.IntVar(&c.JSONMaxLimit, "json-max-limit", c.JSONMaxLimit, "most rows returned per page of -json-path, and the page size when no limit is given; 0 for no cap")
+	fs.StringVar(&c.MetaPath, "meta-path", c.MetaPath, "path describing the columns, row count, size and mtime of registry.tsv, or of a snapshot with ?hash=; empty disables it")
+	fs.BoolVar(&c.Checksums, "checksums", c.Checksums, "answer <path>.sha256 with the SHA-256 of the file at <path>")
+	fs.BoolVar(&c.DigestHeader, "digest-header", c.DigestHeader, "send Repr-Digest with the SHA-256 of each file response as sent, in a trailer when compressed on the fly; each file is read once more to compute it")
+	fs.StringVar(&c.DiffPath, "diff-path", c.DiffPath, "path comparing the snapshots ?from=<hash>&to=<hash> as JSON; empty disables it")
+	fs.StringVar(&c.DiffKey, "diff-key", c.DiffKey, "column matching rows between snapshots in -diff-path; empty for the first column")
+	fs.Int64Var(&c.DiffMaxSize, "diff-max-size", c.DiffMaxSize, "largest snapshot, in bytes, that -diff-path compares; 0 for no limit")
+	fs.StringVar(&c.Validate, "validate", c.Validate, "check the structure of registry.tsv at startup and on SIGHUP: off, warn, or strict to refuse a malformed file")
+	fs.Var(&c.MIME, "mime", "register a Content-Type for an extension, as .ext=type; repeatable")
+	fs.StringVar(&c.MIMEFile, "mime-file", c.MIMEFile, "file of extra Content-Types in mime.types format")
+	fs.Var(&c.TrustedProxies, "trusted-proxies", "comma-separated proxy CIDRs whose X-Forwarded-For header is trusted")
+}
+
+// loadConfig builds the configuration from the defaults, then the file named
+// by -config if any, then the remaining command-line flags.
+func loadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+	var path string
+	fs.StringVar(&path, "config", "", "YAML or JSON config file; command-line flags override its values")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, err
+		}
+		// Parse again so flags given on the command line win over the file.
+		// Repeatable flags start over rather than appending to the file.
+		fs.Visit(func(f *flag.Flag) {
+			if r, ok := f.Value.(interface{ reset() }); ok {
+				r.reset()
+			}
+		})
+		if err := fs.Parse(args); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// loadFile overlays the keys present in the YAML file at path onto c.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	top := doc.Content[0]
+	if top.Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s: top level must be a mapping of keys to values", path)
+	}
+
+	fields := c.fieldsByKey()
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, val := top.Content[i], top.Content[i+1]
+		ptr, ok := fields[key.Value]
+		if !ok {
+			return fmt.Errorf("config %s:%d: unknown key %q", path, key.Line, key.Value)
+		}
+		if err := val.Decode(ptr); err != nil {
+			return fmt.Errorf("config %s:%d: key %q: %v", path, key.Line, key.Value, err)
+		}
+	}
+	return nil
+}
+
+// fieldsByKey maps each YAML key to a pointer to its field in c.
+func (c *Config) fieldsByKey() map[string]any {
+	v := reflect.ValueOf(c).Elem()
+	fields := make(map[string]any, v.NumField())
+	for i := range v.NumField() {
+		if key := v.Type().Field(i).Tag.Get("yaml"); key != "" {
+			fields[key] = v.Field(i).Addr().Interface()
+		}
+	}
+	return fields
+}
+
+// changedKeys returns, sorted, the keys whose values differ between c and old.
+func (c *Config) changedKeys(old *Config) []string {
+	was := old.fieldsByKey()
+	var keys []string
+	for key, ptr := range c.fieldsByKey() {
+		if !reflect.DeepEqual(ptr, was[key]) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// validate checks settings that cannot be validated one value at a time and
+// normalizes the compression, extension and media type lists.
+func (c *Config) validate() error {
+	encodings, err := parseEncodings(c.Compression)
+	if err != nil {
+		return fmt.Errorf("compression: %w", err)
+	}
+	c.Compression = encodings
+	for _, enc := range c.Precompressed {
+		if _, ok := sidecarExts[enc]; !ok {
+			return fmt.Errorf("precompressed: %q must be br or gzip", enc)
+		}
+	}
+	exts, err := parseExts(c.GzipExt)
+	if err != nil {
+		return fmt.Errorf("gzip-ext: %w", err)
+	}
+	c.GzipExt = exts
+	for i, t := range c.GzipTypes {
+		c.GzipTypes[i] = strings.ToLower(t)
+		if !strings.Contains(t, "/") {
+			return fmt.Errorf("gzip-types: %q is not a media type", t)
+		}
+	}
+	c.gzipDenyExts, c.gzipDenyTypes = nil, nil
+	for _, d := range c.GzipDeny {
+		d = strings.ToLower(d)
+		switch {
+		case strings.HasPrefix(d, "."):
+			c.gzipDenyExts = append(c.gzipDenyExts, d)
+		case strings.Contains(d, "/"):
+			c.gzipDenyTypes = append(c.gzipDenyTypes, d)
+		default:
+			return fmt.Errorf("gzip-deny: %q is neither an extension nor a media type", d)
+		}
+	}
+	c.gzipExtLevels = make(map[string]int, len(c.GzipExtLevel))
+	for _, el := range c.GzipExtLevel {
+		ext, level, ok := strings.Cut(el, "=")
+		if !ok || !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("gzip-ext-level: %q must have the form .ext=level", el)
+		}
+		n, err := parseGzipLevel(level)
+		if err != nil {
+			return fmt.Errorf("gzip-ext-level: %w", err)
+		}
+		c.gzipExtLevels[strings.ToLower(ext)] = n
+	}
+
+	if len(c.Addr) == 0 {
+		return fmt.Errorf("addr: at least one listen address is required")
+	}
+	if c.CORS && c.CORSCredentials && slices.Contains(c.CORSOrigins, "*") {
+		return fmt.Errorf("cors-credentials cannot be combined with cors-origins *; list the origins")
+	}
+	if c.Group != "" && c.User == "" {
+		return fmt.Errorf("group needs user")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if c.RedirectAddr != "" && c.TLSCert == "" {
+		return fmt.Errorf("redirect-addr needs tls-cert and tls-key; autocert redirects on :80 by itself")
+	}
+	if len(c.AutocertDomains) > 0 && c.TLSCert != "" {
+		return fmt.Errorf("autocert-domains cannot be combined with tls-cert/tls-key")
+	}
+	if _, ok := embeddedFS(); c.Embedded && !ok {
+		return fmt.Errorf("embedded: binary was built without -tags embed")
+	}
+	if c.trustedProxies, err = parsePrefixes(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted-proxies: %w", err)
+	}
+	if c.RateLimit < 0 || (c.RateLimit > 0 && c.RateBurst < 1) {
+		return fmt.Errorf("rate-limit and rate-burst must be positive")
+	}
+	for i, rule := range c.CacheRules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("cache-rules[%d]: %w", i, err)
+		}
+	}
+	if c.RegistryMaxAge < 0 || c.StaleRevalidate < 0 || c.StaleIfError < 0 {
+		return fmt.Errorf("registry-max-age, registry-stale-while-revalidate and registry-stale-if-error must not be negative")
+	}
+	c.cacheRules = append(slices.Clip(c.CacheRules), cacheRule{
+		Pattern:         "/registry.tsv",
+		CacheControl:    cacheControl{"public"}.seconds("max-age", c.RegistryMaxAge).String(),
+		StaleRevalidate: c.StaleRevalidate,
+		StaleIfError:    c.StaleIfError,
+	})
+	if c.BasicAuth != "" && !strings.Contains(c.BasicAuth, ":") {
+		return fmt.Errorf("basic-auth: want user:pass")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log-format: %q must be text or json", c.LogFormat)
+	}
+	if c.ErrorFormat != "text" && c.ErrorFormat != "json" {
+		return fmt.Errorf("error-format: %q must be text or json", c.ErrorFormat)
+	}
+	if c.RaggedRows != "pad" && c.RaggedRows != "error" {
+		return fmt.Errorf("ragged-rows: %q must be pad or error", c.RaggedRows)
+	}
+	if len(c.IndexFiles) == 0 {
+		return fmt.Errorf("index-files: want at least one name")
+	}
+	for _, name := range c.IndexFiles {
+		if strings.Contains(name, "/") {
+			return fmt.Errorf("index-files: %q must be a file name, not a path", name)
+		}
+	}
+	if c.MaxConns < 0 {
+		return fmt.Errorf("max-conns must not be negative")
+	}
+	if c.MaxConnsMode != "queue" && c.MaxConnsMode != "reject" {
+		return fmt.Errorf("max-conns-mode: %q must be queue or reject", c.MaxConnsMode)
+	}
+	if c.Validate != "off" && c.Validate != "warn" && c.Validate != "strict" {
+		return fmt.Errorf("validate: %q must be off, warn or strict", c.Validate)
+	}
+	if c.GzipFlushSize < 0 {
+		return fmt.Errorf("gzip-flush-size must not be negative")
+	}
+	if c.GzipSniffSize < 0 {
+		return fmt.Errorf("gzip-sniff-size must not be negative")
+	}
+	if c.GzipConcurrency < 0 || c.GzipWait < 0 {
+		return fmt.Errorf("gzip-concurrency and gzip-concurrency-wait must not be negative")
+	}
+	if c.CacheSize < 0 || c.CacheMaxFile < 0 {
+		return fmt.Errorf("cache-size and cache-max-file must not be negative")
+	}
+	if c.JSONMaxLimit < 0 {
+		return fmt.Errorf("json-max-limit must not be negative")
+	}
+	if c.DiffMaxSize < 0 {
+		return fmt.Errorf("diff-max-size must not be negative")
+	}
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("max-file-size must not be negative")
+	}
+	return nil
+}
+
+// credentials returns the Basic auth users configured, or nil when
+// authentication is off.
+func (c *Config) credentials() (*credentials, error) {
+	var creds *credentials
+	if c.BasicAuthFile != "" {
+		var err error
+		if creds, err = loadHtpasswd(c.BasicAuthFile); err != nil {
+			return nil, fmt.Errorf("basic-auth-file: %w", err)
+		}
+	}
+	if user, pass, ok := strings.Cut(c.BasicAuth, ":"); ok {
+		if creds == nil {
+			creds = &credentials{users: make(map[string]string)}
+		}
+		creds.users[user] = pass
+	}
+	return creds, nil
+}
+
+// mounts returns the configured mounts, with Dir mounted at / unless a
+// mount already claims it.
+func (c *Config) mounts() mountList {
+	mounts := slices.Clone(c.Mounts)
+	if !slices.ContainsFunc(mounts, func(m mount) bool { return m.Prefix == "/" }) {
+		mounts = append(mounts, mount{Prefix: "/", Dir: c.Dir})
+	}
+	if c.Embedded {
+		for i := range mounts {
+			if mounts[i].Prefix == "/" {
+				mounts[i].Dir = embeddedDir
+			}
+		}
+	}
+	return mounts
+}
+
+// listValue is a comma-separated flag value. In a config file it may be
+// written either as a YAML sequence or as a comma-separated string.
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+func (l *listValue) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return l.Set(n.Value)
+	}
+	var items []string
+	if err := n.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+// gzipLevel is a gzip compression level parsed by parseGzipLevel.
+type gzipLevel int
+
+func (g *gzipLevel) String() string { return fmt.Sprint(int(*g)) }
+
+func (g *gzipLevel) Set(s string) error {
+	n, err := parseGzipLevel(s)
+	if err != nil {
+		return err
+	}
+	*g = gzipLevel(n)
+	return nil
+}
+
+func (g *gzipLevel) UnmarshalYAML(n *yaml.Node) error { return g.Set(n.Value) }
+
+// embeddedDir stands in for the directory of a mount served by -embedded.
+const embeddedDir = "(embedded)"
+
+// multiValue is a repeatable flag value collecting one item per use. In a
+// config file it is a YAML sequence.
+type multiValue []string
+
+func (m *multiValue) String() string { return strings.Join(*m, ",") }
+
+func (m *multiValue) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
+func (m *multiValue) reset() { *m = nil }
+
+// mount serves Dir under the URL path Prefix.
+type mount struct {
+	Prefix string
+	Dir    string
+}
+
+// mountList is a repeatable prefix=dir flag value. In a config file it is a
+// sequence of prefix=dir strings.
+type mountList []mount
+
+func (m mountList) String() string {
+	parts := make([]string, len(m))
+	for i, mt := range m {
+		parts[i] = mt.Prefix + "=" + mt.Dir
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *mountList) Set(s string) error {
+	prefix, dir, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || dir == "" {
+		return fmt.Errorf("mount %q must have the form /prefix=dir", s)
+	}
+	*m = append(*m, mount{Prefix: prefix, Dir: dir})
+	return nil
+}
+
+func (m *mountList) reset() { *m = nil }
+
+func (m *mountList) UnmarshalYAML(n *yaml.Node) error {
+	var items []string
+	if err := n.Decode(&items); err != nil {
+		return err
+	}
+	*m = nil
+	for _, item := range items {
+		if err := m.Set(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMode is a file permission written in octal, such as 0660.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string { return fmt.Sprintf("%#o", uint32(*m)) }
+
+func (m *fileMode) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("mode %q must be octal permissions such as 0660", s)
+	}
+	*m = fileMode(n)
+	return nil
+}
+
+func (m *fileMode) UnmarshalYAML(n *yaml.Node) error { return m.Set(n.Value) }
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsOptions configures withCORS.
+type corsOptions struct {
+	Origins []string      // allowed origins; "*" allows any
+	Methods []string      // methods allowed in preflight responses
+	Headers []string      // request headers allowed in preflight responses
+	Expose  []string      // response headers scripts may read
+	MaxAge  time.Duration // how long browsers may cache a preflight result
+
+	// Credentials lets requests carry cookies or Basic auth. Browsers
+	// then reject a wildcard origin, so validate refuses that combination.
+	Credentials bool
+}
+
+func (o corsOptions) wildcard() bool { return slices.Contains(o.Origins, "*") }
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" when the origin is not allowed.
+func (o corsOptions) allowedOrigin(origin string) string {
+	if o.wildcard() {
+		return "*"
+	}
+	if origin != "" && slices.Contains(o.Origins, origin) {
+		return origin
+	}
+	return ""
+}
+
+func withCORS(opts corsOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		allow := opts.allowedOrigin(r.Header.Get("Origin"))
+		if allow != "" {
+			h.Set("Access-Control-Allow-Origin", allow)
+			if opts.Credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if !opts.wildcard() {
+			h.Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", strings.Join(opts.Methods, ", "))
+			headers := strings.Join(opts.Headers, ", ")
+			if headers == "*" && opts.Credentials {
+				// With credentials a * is taken literally, so name the
+				// headers the browser is asking for instead.
+				headers = r.Header.Get("Access-Control-Request-Headers")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allow != "" && len(opts.Expose) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(opts.Expose, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
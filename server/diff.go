@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// registryDiff compares two registry snapshots, named by the hashes in the
+// from and to parameters, and returns the rows added, removed and changed
+// between them as JSON. Rows are matched by the key column, or by the first
+// column when key is empty. Both files are held in memory while they are
+// compared, so snapshots larger than maxSize are refused.
+type registryDiff struct {
+	root    http.FileSystem
+	key     string
+	pad     bool  // pad ragged rows instead of failing
+	maxSize int64 // largest snapshot compared, in bytes
+}
+
+// snapshotRows is a registry file read into memory, with its rows indexed
+// by the key column.
+type snapshotRows struct {
+	header []string
+	keys   []string // in file order
+	rows   map[string][]string
+}
+
+func (d registryDiff) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var snaps [2]*snapshotRows
+	for i, p := range []string{"from", "to"} {
+		name := snapshotName(q.Get(p))
+		if name == "" {
+			httpError(w, r, fmt.Sprintf("%s must be a snapshot hash", p), http.StatusBadRequest)
+			return
+		}
+		s, code, err := d.read(name)
+		if err != nil {
+			httpError(w, r, err.Error(), code)
+			return
+		}
+		snaps[i] = s
+	}
+	from, to := snaps[0], snaps[1]
+	fromKeys, toKeys := keys(from.header), keys(to.header)
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"added":[`)
+	n := 0
+	for _, k := range to.keys {
+		if _, ok := from.rows[k]; !ok {
+			if n++; n > 1 {
+				bw.WriteByte(',')
+			}
+			writeJSONObject(bw, toKeys, to.rows[k])
+		}
+	}
+	bw.WriteString(`],"removed":[`)
+	n = 0
+	for _, k := range from.keys {
+		if _, ok := to.rows[k]; !ok {
+			if n++; n > 1 {
+				bw.WriteByte(',')
+			}
+			writeJSONObject(bw, fromKeys, from.rows[k])
+		}
+	}
+	bw.WriteString(`],"changed":[`)
+	n = 0
+	for _, k := range to.keys {
+		old, ok := from.rows[k]
+		if !ok || sameRow(from.header, old, to.header, to.rows[k]) {
+			continue
+		}
+		if n++; n > 1 {
+			bw.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		bw.WriteString(`{"key":`)
+		bw.Write(key)
+		bw.WriteString(`,"from":`)
+		writeJSONObject(bw, fromKeys, old)
+		bw.WriteString(`,"to":`)
+		writeJSONObject(bw, toKeys, to.rows[k])
+		bw.WriteByte('}')
+	}
+	bw.WriteString("]}\n")
+	bw.Flush()
+}
+
+// bounded reports whether the diff for r can be coalesced. Both snapshots
+// are held in memory to compare them, so a diff is no larger than that
+// whenever maxSize caps them.
+func (d registryDiff) bounded(r *http.Request) bool { return d.maxSize > 0 }
+
+// read loads the snapshot called name, returning with any error the status
+// code to answer it with.
+func (d registryDiff) read(name string) (*snapshotRows, int, error) {
+	f, err := d.root.Open(name)
+	if err != nil {
+		return nil, http.StatusNotFound, fmt.Errorf("no snapshot %s", name)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return nil, http.StatusNotFound, fmt.Errorf("no snapshot %s", name)
+	}
+	if d.maxSize > 0 && fi.Size() > d.maxSize {
+		return nil, http.StatusForbidden, fmt.Errorf("snapshot %s is too large to compare", name)
+	}
+
+	t := newTSVReader(f)
+	header, err := t.next()
+	if err == io.EOF {
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("snapshot %s has no header row", name)
+	}
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("%s: %s", name, http.StatusText(http.StatusInternalServerError))
+	}
+	col := 0
+	if d.key != "" {
+		if col = slices.Index(header, d.key); col < 0 {
+			return nil, http.StatusUnprocessableEntity, fmt.Errorf("snapshot %s has no column %q", name, d.key)
+		}
+	}
+
+	s := &snapshotRows{header: header, rows: make(map[string][]string)}
+	for {
+		row, err := t.next()
+		if err == io.EOF {
+			return s, 0, nil
+		}
+		if err == nil {
+			row, err = fitRow(row, len(header), d.pad)
+		}
+		if err != nil {
+			log.Printf("%s:%d: %v", name, t.line, err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("%s line %d: %v", name, t.line, err)
+		}
+		k := row[col]
+		if _, dup := s.rows[k]; !dup {
+			s.keys = append(s.keys, k)
+		}
+		s.rows[k] = row
+	}
+}
+
+// sameRow reports whether rows a and b, under headers ha and hb, hold the
+// same value in every column by name. Reordering columns, or adding or
+// dropping an empty one, does not change a row.
+func sameRow(ha, a, hb, b []string) bool {
+	if slices.Equal(ha, hb) {
+		return slices.Equal(a, b)
+	}
+	cells := make(map[string]string, len(ha))
+	for i, col := range ha {
+		cells[col] = a[i]
+	}
+	for i, col := range hb {
+		if v, ok := cells[col]; ok || b[i] != "" {
+			if v != b[i] {
+				return false
+			}
+			delete(cells, col)
+		}
+	}
+	for _, v := range cells {
+		if v != "" {
+			return false
+		}
+	}
+	return true
+}
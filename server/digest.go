@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+// reprDigest formats a SHA-256 as an RFC 9530 Repr-Digest value.
+func reprDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// digestDeferredKey is the context key withCompression sets on requests
+// whose Repr-Digest it takes over from withDigest.
+type digestDeferredKey struct{}
+
+// withDigest sets Repr-Digest on the file responses of next to the SHA-256
+// of the file, cached in sums, so clients can check a download without
+// fetching a checksum as well. Range requests go without it, as the parts
+// sent would not add up to what it covers. When the response may be
+// compressed on the fly, withCompression handles the digest instead, so
+// that the file is not hashed for a header it would only replace;
+// sidecars and cached copies have theirs set up front.
+func withDigest(root http.FileSystem, sums *sumCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deferred, _ := r.Context().Value(digestDeferredKey{}).(bool); r.Header.Get("Range") != "" || deferred {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if d := fileDigest(root, sums, r.URL.Path); d != "" {
+			w.Header().Set("Repr-Digest", d)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fileDigest returns the Repr-Digest of the file called name in root, or ""
+// when there is no such file.
+func fileDigest(root http.FileSystem, sums *sumCache, name string) string {
+	f, err := root.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return ""
+	}
+	sum, err := sums.sum(name, f, fi)
+	if err != nil {
+		log.Printf("digest %s: %v", name, err)
+		return ""
+	}
+	return reprDigest(sum)
+}
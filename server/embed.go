@@ -0,0 +1,27 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// embeddedDist is the dist directory compiled into the binary. Copy it next
+// to the sources before building:
+//
+//	cp -r ../dist dist && go build -tags embed
+//
+//go:embed dist
+var embeddedDist embed.FS
+
+// embeddedFS returns the embedded dist directory, reporting whether this
+// binary was built with one.
+func embeddedFS() (http.FileSystem, bool) {
+	sub, err := fs.Sub(embeddedDist, "dist")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub), true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// errorFormatKey is the context key under which withErrorFormat stores the
+// format that httpError answers in.
+type errorFormatKey struct{}
+
+// withErrorFormat has httpError answer the requests through next in format,
+// text or json.
+func withErrorFormat(format string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorFormatKey{}, format)))
+	})
+}
+
+// jsonErrors reports whether errors for r are answered in JSON.
+func jsonErrors(r *http.Request) bool {
+	format, _ := r.Context().Value(errorFormatKey{}).(string)
+	return format == "json"
+}
+
+// httpError is http.Error, except that under -error-format json the body is
+// an object such as {"error":"not found","status":404}. The file server's
+// own errors, such as a 404 for a missing file, stay plain text for
+// browsers whatever the format.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !jsonErrors(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{msg, code})
+}
+
+// notFound is http.NotFound through httpError.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	msg := "404 page not found"
+	if jsonErrors(r) {
+		msg = "not found"
+	}
+	httpError(w, r, msg, http.StatusNotFound)
+}
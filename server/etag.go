@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isSnapshotPath reports whether p names an immutable, content-addressed
+// snapshot such as /registry.75a56b48d617c730.tsv.
+func isSnapshotPath(p string) bool {
+	hash, ok := strings.CutPrefix(p, "/registry.")
+	if !ok {
+		return false
+	}
+	hash, ok = strings.CutSuffix(hash, ".tsv")
+	return ok && hash != "" && !strings.Contains(hash, "/")
+}
+
+// etagEntry is a content hash along with the file state it was computed for.
+type etagEntry struct {
+	size int64
+	mod  time.Time
+	tag  string
+}
+
+// withETag sets an ETag on file responses and answers a matching
+// If-None-Match with 304 itself, before compression or the file server get
+// involved. Snapshots get a strong tag from their content hash, cached until
+// the file changes; other files get a cheap weak tag from size and mtime.
+// The tag of an encoded variant carries the encoding as a suffix, see
+// etagForEncoding, and a request naming any variant's tag is matched. For
+// paths that varies reports as having encoded variants, the 304 carries the
+// Vary header the full response would, so caches keep keying on it.
+func withETag(root http.FileSystem, varies func(name string) bool, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	hashes := make(map[string]etagEntry)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := root.Open(r.URL.Path)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			f.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var tag string
+		if !isSnapshotPath(r.URL.Path) {
+			tag = fmt.Sprintf(`W/"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			mu.Lock()
+			e, ok := hashes[r.URL.Path]
+			mu.Unlock()
+			if !ok || e.size != fi.Size() || !e.mod.Equal(fi.ModTime()) {
+				h := sha256.New()
+				if _, err := io.Copy(h, f); err == nil {
+					e = etagEntry{fi.Size(), fi.ModTime(), `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`}
+					mu.Lock()
+					hashes[r.URL.Path] = e
+					mu.Unlock()
+				}
+			}
+			tag = e.tag
+		}
+		f.Close()
+
+		if tag == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			if matched, ok := matchVariant(inm, tag); ok {
+				// 304 has no body, so there is nothing to compress.
+				w.Header().Set("ETag", matched)
+				if varies(r.URL.Path) {
+					w.Header().Add("Vary", "Accept-Encoding")
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		r = checkIfRange(r, tag)
+		w.Header().Set("ETag", tag)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkIfRange settles an If-Range that names an entity tag against tag,
+// the tag of the identity representation that byte ranges are served from.
+// When they match the Range stands, otherwise it is dropped so the whole
+// file is sent. http.ServeContent only accepts strong tags here, which
+// would make every resume of a file with a size and mtime tag start over.
+// An If-Range date is left to http.ServeContent.
+func checkIfRange(r *http.Request, tag string) *http.Request {
+	ir := r.Header.Get("If-Range")
+	if ir == "" || r.Header.Get("Range") == "" || !strings.HasPrefix(ir, `"`) && !strings.HasPrefix(ir, `W/"`) {
+		return r
+	}
+	r = r.Clone(r.Context())
+	if !weakEqual(ir, tag) {
+		r.Header.Del("Range")
+	}
+	r.Header.Del("If-Range")
+	return r
+}
+
+// matchVariant reports which of tag and its encoded variants the
+// If-None-Match header inm names, using the weak comparison that
+// If-None-Match calls for.
+func matchVariant(inm, tag string) (string, bool) {
+	for _, c := range strings.Split(inm, ",") {
+		c = strings.TrimSpace(c)
+		if c == "*" {
+			return tag, true
+		}
+		if weakEqual(c, tag) {
+			return tag, true
+		}
+		for enc := range encoders {
+			if v := etagForEncoding(tag, enc); weakEqual(c, v) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// weakEqual compares entity tags ignoring any W/ prefix.
+func weakEqual(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// etagForEncoding marks an entity tag as belonging to the enc-encoded
+// representation, e.g. "abc" becomes "abc-gzip".
+func etagForEncoding(tag, enc string) string {
+	if !strings.HasSuffix(tag, `"`) {
+		return tag
+	}
+	return strings.TrimSuffix(tag, `"`) + "-" + enc + `"`
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestETagNotModified(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"registry.tsv": testRegistry(200)}, nil)
+	for _, tt := range []struct {
+		name, accept, suffix string
+	}{
+		{"identity", "", ""},
+		{"gzip", "gzip", `-gzip"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			first := get(h, "/registry.tsv", "Accept-Encoding", tt.accept)
+			tag := first.Header().Get("ETag")
+			if first.Code != http.StatusOK || tag == "" {
+				t.Fatalf("status %d, ETag %q", first.Code, tag)
+			}
+			if tt.suffix != "" && !strings.HasSuffix(tag, tt.suffix) {
+				t.Errorf("ETag %s lacks %s", tag, tt.suffix)
+			}
+			w := get(h, "/registry.tsv", "Accept-Encoding", tt.accept, "If-None-Match", tag)
+			if w.Code != http.StatusNotModified {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusNotModified)
+			}
+			if got := w.Header().Get("ETag"); got != tag {
+				t.Errorf("304 ETag %s, want %s", got, tag)
+			}
+		})
+	}
+}
+
+// TestRevalidateAfterMaxAge plays a client whose cached copy of the mutable
+// registry has outlived its max-age: it revalidates with If-None-Match and
+// gets a 304 that renews the max-age while the file is unchanged, and the
+// new file once it has changed.
+func TestRevalidateAfterMaxAge(t *testing.T) {
+	var dir string
+	h := newTestHandler(t, map[string]string{"registry.tsv": testRegistry(200)}, func(c *Config) { dir = c.Dir })
+
+	first := get(h, "/registry.tsv")
+	tag, cc := first.Header().Get("ETag"), first.Header().Get("Cache-Control")
+	if first.Code != http.StatusOK || tag == "" || !strings.Contains(cc, "max-age=60") {
+		t.Fatalf("status %d, ETag %q, Cache-Control %q", first.Code, tag, cc)
+	}
+
+	w := get(h, "/registry.tsv", "If-None-Match", tag)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged: status %d, want %d", w.Code, http.StatusNotModified)
+	}
+	if got := w.Header().Get("Cache-Control"); got != cc {
+		t.Errorf("unchanged: Cache-Control %q, want %q", got, cc)
+	}
+
+	name := filepath.Join(dir, "registry.tsv")
+	if err := os.WriteFile(name, []byte(testRegistry(201)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	w = get(h, "/registry.tsv", "If-None-Match", tag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("changed: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("ETag"); got == tag {
+		t.Errorf("changed: ETag still %s", got)
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	const tag = `W/"18de4da9e6dffb03-a5"`
+	for _, tt := range []struct {
+		name, ifRange string
+		keepRange     bool
+	}{
+		{"matching", tag, true},
+		{"matching strong form", `"18de4da9e6dffb03-a5"`, true},
+		{"stale", `W/"18de4da9e6dffb03-a4"`, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/registry.tsv", nil)
+			r.Header.Set("Range", "bytes=10-")
+			r.Header.Set("If-Range", tt.ifRange)
+			got := checkIfRange(r, tag)
+			if keep := got.Header.Get("Range") != ""; keep != tt.keepRange {
+				t.Errorf("Range kept: %v, want %v", keep, tt.keepRange)
+			}
+			if ir := got.Header.Get("If-Range"); ir != "" {
+				t.Errorf("If-Range %q left for the file server", ir)
+			}
+			if r.Header.Get("Range") == "" {
+				t.Error("original request changed")
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/registry.tsv", nil)
+	r.Header.Set("Range", "bytes=10-")
+	r.Header.Set("If-Range", "Wed, 14 Oct 2026 05:18:13 GMT")
+	if got := checkIfRange(r, tag); got != r {
+		t.Error("If-Range date not left to http.ServeContent")
+	}
+}
+
+func TestIfRangeResume(t *testing.T) {
+	registry := testRegistry(200)
+	h := newTestHandler(t, map[string]string{"registry.tsv": registry}, nil)
+	tag := get(h, "/registry.tsv").Header().Get("ETag")
+	for _, tt := range []struct {
+		name, ifRange string
+		code          int
+		body          string
+	}{
+		{"matching", tag, http.StatusPartialContent, registry[100:]},
+		{"stale", `W/"0-0"`, http.StatusOK, registry},
+	} {
+		w := get(h, "/registry.tsv", "Range", "bytes=100-", "If-Range", tt.ifRange)
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: %d byte body, want %d", tt.name, w.Body.Len(), len(tt.body))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment line, which
+// keeps proxies from timing it out and notices clients that went away.
+const sseKeepAlive = 30 * time.Second
+
+// registryEvent is the payload of an "update" event.
+type registryEvent struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// registryEvents streams an event to each subscriber whenever the registry
+// file in dir changes. The directory is watched only while someone listens.
+type registryEvents struct {
+	dir, name string
+
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	subs    map[chan registryEvent]struct{}
+}
+
+func newRegistryEvents(dir, name string) *registryEvents {
+	return &registryEvents{dir: dir, name: name, subs: make(map[chan registryEvent]struct{})}
+}
+
+// subscribe registers a new listener, starting the watcher for the first.
+func (e *registryEvents) subscribe() (chan registryEvent, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		// Watch the directory rather than the file so that a registry
+		// replaced by rename is still seen.
+		if err := w.Add(e.dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+		e.watcher = w
+		go e.run(w)
+	}
+	ch := make(chan registryEvent, 1)
+	e.subs[ch] = struct{}{}
+	return ch, nil
+}
+
+// unsubscribe drops ch, stopping the watcher after the last listener leaves.
+func (e *registryEvents) unsubscribe(ch chan registryEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subs, ch)
+	if len(e.subs) == 0 && e.watcher != nil {
+		e.watcher.Close()
+		e.watcher = nil
+	}
+}
+
+func (e *registryEvents) run(w *fsnotify.Watcher) {
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(ev.Name) != e.name || !ev.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			fi, err := os.Stat(filepath.Join(e.dir, e.name))
+			if err != nil {
+				continue
+			}
+			e.broadcast(registryEvent{Name: "/" + e.name, Size: fi.Size(), ModTime: fi.ModTime().UTC()})
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("events: %v", err)
+		}
+	}
+}
+
+// broadcast hands ev to every subscriber. A subscriber that has not taken the
+// previous event gets this one in its place, so slow clients only ever see
+// the latest state.
+func (e *registryEvents) broadcast(ev registryEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- ev
+	}
+}
+
+func (e *registryEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		// A stream has no length, and there is nothing to wait for.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	rc := http.NewResponseController(w)
+	ch, err := e.subscribe()
+	if err != nil {
+		log.Printf("events: %v", err)
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer e.unsubscribe(ch)
+
+	// The stream outlives the server's write timeout.
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	tick := time.NewTicker(sseKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown(r.Context()):
+			return
+		case <-tick.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: update\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// defaultFavicon is the favicon.ico served when neither the directory nor
+// -favicon provides one, so browsers stop filling the log with 404s.
+//
+//go:embed favicon.ico
+var defaultFavicon []byte
+
+// withFavicon answers /favicon.ico with icon unless root has a favicon.ico
+// of its own, which next then serves like any other file. The icon only
+// changes with the binary or the configuration, so clients may keep it for
+// a year without asking again.
+func withFavicon(root http.FileSystem, icon []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, err := root.Open("/favicon.ico"); err == nil {
+			f.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "image/x-icon")
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		writeBody(w, r, icon)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// noListingFS hides directories that have no index.html, so http.FileServer
+// answers 404 instead of generating a listing. Wrapped around indexFS, any
+// of its index names will do.
+type noListingFS struct {
+	http.FileSystem
+}
+
+func (fs noListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return f, nil
+	}
+
+	index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
+
+// indexFS resolves the index.html that http.FileServer looks for in a
+// directory to the first of names present there, so that directories may
+// use index.htm or default.html instead.
+type indexFS struct {
+	http.FileSystem
+	names []string
+}
+
+func (fs indexFS) Open(name string) (http.File, error) {
+	dir, file := path.Split(name)
+	if file != "index.html" {
+		return fs.FileSystem.Open(name)
+	}
+	for _, index := range fs.names {
+		if f, err := fs.FileSystem.Open(dir + index); err == nil {
+			return f, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// safeFS refuses names that are not clean absolute paths or that contain a
+// backslash or NUL, so nothing that slipped past withCleanPath can reach
+// outside the served directory.
+type safeFS struct {
+	http.FileSystem
+}
+
+func (fs safeFS) Open(name string) (http.File, error) {
+	clean := path.Clean(name)
+	if !strings.HasPrefix(name, "/") || name != clean && name != clean+"/" || strings.ContainsAny(name, "\\\x00") {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Open(name)
+}
+
+// noDotfilesFS refuses any path with a segment beginning with a dot, such as
+// /.git/config or /sub/.hidden/file. Dots elsewhere in a name are fine.
+type noDotfilesFS struct {
+	http.FileSystem
+}
+
+func (fs noDotfilesFS) Open(name string) (http.File, error) {
+	if hasDotSegment(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Open(name)
+}
+
+func hasDotSegment(name string) bool {
+	for _, seg := range strings.Split(name, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// rootedFS refuses files whose real path, once symlinks are resolved, lies
+// outside dir, so a link inside the served directory cannot expose the rest
+// of the file system. Links that stay within dir are followed as usual.
+type rootedFS struct {
+	http.FileSystem
+	dir string
+}
+
+func (fs rootedFS) Open(name string) (http.File, error) {
+	// The root is resolved on each call, since it may itself be a link
+	// that a deployment swaps to a new release.
+	root, err := filepath.EvalSymlinks(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+	return fs.FileSystem.Open(name)
+}
+
+// maxSizeFS refuses regular files larger than max bytes with a permission
+// error, which http.FileServer answers with 403. The check is on the whole
+// file, so a byte range of a large file is refused as well.
+type maxSizeFS struct {
+	http.FileSystem
+	max int64
+}
+
+func (fs maxSizeFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.IsDir() && fi.Size() > fs.max {
+		f.Close()
+		return nil, os.ErrPermission
+	}
+	return f, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDotfilesHidden(t *testing.T) {
+	files := map[string]string{
+		".env":             "SECRET=1",
+		"sub/.hidden/file": "x",
+		"registry.v2.tsv":  "slug\n",
+	}
+	h := newTestHandler(t, files, nil)
+	for _, tt := range []struct {
+		target string
+		code   int
+	}{
+		{"/.env", http.StatusNotFound},
+		{"/sub/.hidden/file", http.StatusNotFound},
+		{"/registry.v2.tsv", http.StatusOK},
+	} {
+		if w := get(h, tt.target); w.Code != tt.code {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.code)
+		}
+	}
+}
+
+func TestRootedFSSymlinks(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a": "inside"})
+	outside := writeFiles(t, map[string]string{"secret": "outside"})
+	for link, target := range map[string]string{
+		"in":  "a",
+		"out": filepath.Join(outside, "secret"),
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+	root := rootedFS{http.Dir(dir), dir}
+
+	f, err := root.Open("/in")
+	if err != nil {
+		t.Fatalf("Open(/in): %v", err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "inside" {
+		t.Errorf("/in reads %q, %v", b, err)
+	}
+
+	if f, err := root.Open("/out"); !errors.Is(err, fs.ErrNotExist) {
+		if err == nil {
+			f.Close()
+		}
+		t.Errorf("Open(/out): %v, want fs.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// encodedKey identifies one encoded representation of a file.
+type encodedKey struct {
+	name, encoding string
+}
+
+// encodedEntry is a compressed file body along with the file state it was
+// compressed from.
+type encodedEntry struct {
+	key   encodedKey
+	mod   time.Time
+	size  int64 // of the uncompressed file
+	ctype string
+	data  []byte
+
+	// digest is the Repr-Digest of data, set when digests are enabled.
+	digest string
+}
+
+// encodedCache keeps compressed file bodies in memory, evicting the least
+// recently used once their total size passes maxBytes.
+type encodedCache struct {
+	maxBytes int64
+	maxFile  int64 // files larger than this are not cached
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // of *encodedEntry, most recent first
+	items map[encodedKey]*list.Element
+}
+
+func newEncodedCache(maxBytes, maxFile int64) *encodedCache {
+	return &encodedCache{
+		maxBytes: maxBytes,
+		maxFile:  maxFile,
+		lru:      list.New(),
+		items:    make(map[encodedKey]*list.Element),
+	}
+}
+
+// get returns the entry for k if it was made from a file of the given
+// modification time and size. A stale entry is dropped.
+func (c *encodedCache) get(k encodedKey, mod time.Time, size int64) (*encodedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*encodedEntry)
+	if !e.mod.Equal(mod) || e.size != size {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *encodedCache) put(e *encodedEntry) {
+	n := int64(len(e.data))
+	if n > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		c.remove(el)
+	}
+	c.items[e.key] = c.lru.PushFront(e)
+	c.bytes += n
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops el; c.mu must be held.
+func (c *encodedCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*encodedEntry)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.data))
+}
+
+// encode compresses data with the named encoding at level.
+func encode(encoding string, level int, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := encoders[encoding](&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(data); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// encodeLimit bounds how many responses are compressed on the fly at once,
+// so a burst of requests cannot take every core. A response that finds no
+// slot free goes out uncompressed rather than failing. A nil *encodeLimit
+// imposes no limit.
+type encodeLimit struct {
+	slots chan struct{}
+	wait  time.Duration // how long to wait for a slot; 0 never waits
+}
+
+func newEncodeLimit(n int, wait time.Duration) *encodeLimit {
+	return &encodeLimit{slots: make(chan struct{}, n), wait: wait}
+}
+
+// acquire takes a slot, waiting up to l.wait for one to free up, and
+// reports whether it got one. It gives up early once ctx is done.
+func (l *encodeLimit) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(l.wait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// release gives back a slot taken by acquire.
+func (l *encodeLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
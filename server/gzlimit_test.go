@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkGzipConcurrency serves a registry at BestCompression to many
+// clients at once, with and without a -gzip-concurrency limit of one slot
+// per core, and reports the median and 99th percentile latency along with
+// the share of responses that went out uncompressed for want of a slot.
+func BenchmarkGzipConcurrency(b *testing.B) {
+	body := []byte(testRegistry(2000))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		writeBody(w, r, body)
+	})
+	for _, bm := range []struct {
+		name  string
+		limit *encodeLimit
+	}{
+		{"unlimited", nil},
+		{"limit=" + strconv.Itoa(runtime.GOMAXPROCS(0)), newEncodeLimit(runtime.GOMAXPROCS(0), 0)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			opts := compressOptions{Encodings: []string{"gzip"}, Exts: []string{".tsv"}, GzipLevel: 9, MinSize: 1400, Limit: bm.limit}
+			h := withCompression(opts, http.Dir(b.TempDir()), next)
+
+			var mu sync.Mutex
+			var latencies []time.Duration
+			identity := 0
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					r := httptest.NewRequest(http.MethodGet, "/registry.tsv", nil)
+					r.Header.Set("Accept-Encoding", "gzip")
+					w := httptest.NewRecorder()
+					start := time.Now()
+					h.ServeHTTP(w, r)
+					d := time.Since(start)
+					mu.Lock()
+					latencies = append(latencies, d)
+					if w.Header().Get("Content-Encoding") == "" {
+						identity++
+					}
+					mu.Unlock()
+				}
+			})
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			pct := func(p float64) float64 {
+				return float64(latencies[int(p*float64(len(latencies)-1))].Microseconds()) / 1000
+			}
+			b.ReportMetric(pct(0.50), "p50-ms")
+			b.ReportMetric(pct(0.99), "p99-ms")
+			b.ReportMetric(100*float64(identity)/float64(len(latencies)), "uncompressed-%")
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexEntry describes one registry file in /index.json.
+type indexEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	// Current marks the snapshot holding the same version as registry.tsv.
+	Current bool `json:"current,omitempty"`
+}
+
+// registryIndex lists the .tsv files under root, rescanning at most once
+// per ttl. The hashed alias of registry.tsv, when served, is listed as the
+// current snapshot.
+type registryIndex struct {
+	root  http.FileSystem
+	alias *snapshotAlias // may be nil
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	scanned time.Time
+	body    []byte
+}
+
+func newRegistryIndex(root http.FileSystem, alias *snapshotAlias, ttl time.Duration) *registryIndex {
+	return &registryIndex{root: root, alias: alias, ttl: ttl}
+}
+
+func (x *registryIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := x.get()
+	if err != nil {
+		log.Printf("index: %v", err)
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, r, body)
+}
+
+func (x *registryIndex) get() ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.body != nil && time.Since(x.scanned) < x.ttl {
+		return x.body, nil
+	}
+
+	entries := []indexEntry{}
+	if err := walkFiles(x.root, "/", func(name string, e indexEntry) {
+		if path.Ext(name) == ".tsv" {
+			entries = append(entries, e)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	current := ""
+	if snap := x.alias.current(); snap != nil {
+		current = x.alias.path(snap)
+		if !slices.ContainsFunc(entries, func(e indexEntry) bool { return e.Name == current }) {
+			entries = append(entries, indexEntry{Name: current, Size: int64(len(snap.data)), ModTime: snap.mod.UTC()})
+		}
+	} else if v := registryVersion(x.root, "/registry.tsv"); v != "" {
+		current = "/registry." + v + ".tsv"
+	}
+	for i := range entries {
+		entries[i].Current = entries[i].Name == current
+	}
+
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	x.body, x.scanned = append(body, '\n'), time.Now()
+	return x.body, nil
+}
+
+// walkFiles calls fn for every regular file below dir, or link to one,
+// skipping dotfiles.
+func walkFiles(root http.FileSystem, dir string, fn func(name string, e indexEntry)) error {
+	d, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		name := path.Join(dir, fi.Name())
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			// Readdir describes the link itself. A link to a regular file
+			// is listed as that file, provided root lets it be opened.
+			if fi = statFile(root, name); fi == nil {
+				continue
+			}
+		}
+		if fi.IsDir() {
+			if err := walkFiles(root, name, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi.Mode().IsRegular() {
+			fn(name, indexEntry{Name: name, Size: fi.Size(), ModTime: fi.ModTime().UTC()})
+		}
+	}
+	return nil
+}
+
+// statFile returns the info of the regular file called name in root, or nil
+// if it is anything else or cannot be opened.
+func statFile(root http.FileSystem, name string) fs.FileInfo {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return fi
+}
+
+// registryVersion returns the version recorded in the #v= header line the
+// build script writes at the top of a registry file, or "".
+func registryVersion(root http.FileSystem, name string) string {
+	f, err := root.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	v, ok := strings.CutPrefix(strings.TrimSpace(line), "#v=")
+	if !ok {
+		return ""
+	}
+	return v
+}
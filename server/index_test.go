@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIndexListsLinkedFiles(t *testing.T) {
+	var dir string
+	files := map[string]string{"releases/r2.tsv": testRegistry(10)}
+	h := newTestHandler(t, files, func(c *Config) {
+		dir = c.Dir
+		if err := os.Symlink(filepath.Join("releases", "r2.tsv"), filepath.Join(dir, "registry.tsv")); err != nil {
+			t.Skip(err)
+		}
+	})
+	w := get(h, "/index.json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var entries []indexEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(entries, func(e indexEntry) bool { return e.Name == "/registry.tsv" })
+	if i < 0 {
+		t.Fatalf("/registry.tsv missing from %s", w.Body)
+	}
+	if want := int64(len(files["releases/r2.tsv"])); entries[i].Size != want {
+		t.Errorf("linked file listed with size %d, want its target's %d", entries[i].Size, want)
+	}
+}
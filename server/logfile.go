@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// logFile is a log destination that can be reopened at the same path, so
+// that after logrotate moves the file away the next lines start a new one.
+type logFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// reopen opens the path anew and switches writes over to it. The new file
+// is open before the old one closes, and each log line is a single Write,
+// so no line is lost or split between the two. On error the old file stays
+// in use.
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
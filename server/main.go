@@ -1,75 +1,408 @@
 package main
 
 import (
-	"compress/gzip"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
-	"path/filepath"
+	"os"
+	"slices"
 	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
-type gzipResponseWriter struct {
-	http.ResponseWriter
-	w io.Writer
+func main() {
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.LogFile != "" {
+		lf, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			log.Fatalf("log-file: %v", err)
+		}
+		log.SetOutput(lf)
+		// Registered ahead of the reload, so its messages already go to
+		// the new file.
+		onReload(func() {
+			if err := lf.reopen(); err != nil {
+				log.Printf("log-file: %v", err)
+			}
+		})
+	}
+
+	_ = mime.AddExtensionType(".tsv", "text/tab-separated-values; charset=utf-8")
+	m, lim := newMetrics(), newIPLimiter(cfg.RateLimit, cfg.RateBurst)
+	h, ah, err := buildHandler(&cfg, m, lim)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler, admin := new(swapHandler), new(swapHandler)
+	handler.set(h)
+	if ah != nil {
+		admin.set(ah)
+	}
+	running := &cfg
+	onReload(func() { running = reload(running, m, lim, handler, admin) })
+
+	// In reject mode -max-conns counts requests in flight instead, so idle
+	// keep-alive connections cost nothing and excess requests get 503.
+	var front http.Handler = handler
+	if cfg.MaxConns > 0 && cfg.MaxConnsMode == "reject" {
+		// It sits in front of the reloadable handler, so its rejections
+		// keep the -error-format the server started with.
+		front = withErrorFormat(cfg.ErrorFormat, withMaxInFlight(cfg.MaxConns, handler))
+	}
+	b := &binder{mode: os.FileMode(cfg.SocketMode)}
+	var runners []runner
+	scheme, hosts := "http", strings.Join(cfg.Addr, ", http://")
+
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		domains := cfg.AutocertDomains
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cfg.AutocertCache),
+		}
+
+		srv := cfg.newServer(":443", front)
+		srv.TLSConfig = m.TLSConfig()
+		ln := cfg.mustListenPublic(b, srv.Addr)
+		runners = append(runners, runner{srv, func() error { return srv.ServeTLS(ln, "", "") }})
+
+		// :80 answers ACME HTTP-01 challenges and redirects everything else.
+		challenge := cfg.newServer(":80", m.HTTPHandler(nil))
+		cln := b.mustListen(challenge.Addr)
+		runners = append(runners, runner{challenge, func() error { return challenge.Serve(cln) }})
+		scheme, hosts = "https", strings.Join(domains, ", https://")
+	case cfg.TLSCert != "":
+		for _, addr := range cfg.Addr {
+			srv := cfg.newServer(addr, front)
+			ln := cfg.mustListenPublic(b, addr)
+			runners = append(runners, runner{srv, func() error { return srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey) }})
+		}
+		scheme, hosts = "https", strings.Join(cfg.Addr, ", https://")
+
+		if cfg.RedirectAddr != "" {
+			_, port, _ := net.SplitHostPort(cfg.Addr[0])
+			redirect := cfg.newServer(cfg.RedirectAddr, redirectToHTTPS(port))
+			rln := b.mustListen(redirect.Addr)
+			runners = append(runners, runner{redirect, func() error { return redirect.Serve(rln) }})
+		}
+	default:
+		for _, addr := range cfg.Addr {
+			srv := cfg.newServer(addr, front)
+			ln := cfg.mustListenPublic(b, addr)
+			runners = append(runners, runner{srv, func() error { return srv.Serve(ln) }})
+		}
+	}
+
+	if cfg.AdminAddr != "" {
+		adm := cfg.newServer(cfg.AdminAddr, admin)
+		aln := b.mustListen(adm.Addr)
+		runners = append(runners, runner{adm, func() error { return adm.Serve(aln) }})
+		log.Printf("admin endpoints at http://%s", cfg.AdminAddr)
+	}
+
+	// Everything that may need root is bound by now; nothing is served yet.
+	if cfg.User != "" {
+		if err := dropPrivileges(cfg.User, cfg.Group); err != nil {
+			b.closeAll()
+			log.Fatal(err)
+		}
+		log.Printf("running as user %s", cfg.User)
+	}
+
+	served := cfg.Dir
+	if len(cfg.Mounts) > 0 || cfg.Embedded {
+		served = cfg.mounts().String()
+	}
+	fmt.Printf("Serving %s at %s://%s (%s)\n", served, scheme, hosts, currentBuild())
+	if err := serveUntilSignal(runners, cfg.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (g gzipResponseWriter) Write(b []byte) (int, error) { return g.w.Write(b) }
+// buildHandler assembles the whole request handling stack for cfg, along
+// with the handler for -admin-addr when that is set. It is called again on
+// each reload, so it must not have lasting side effects other than
+// registering MIME types, which only ever accumulate, and setting the rate
+// of lim, which outlives the handlers so clients keep their buckets.
+func buildHandler(cfg *Config, m *metrics, lim *ipLimiter) (handler, admin http.Handler, err error) {
+	if err := registerMIME(cfg.MIME, cfg.MIMEFile); err != nil {
+		return nil, nil, err
+	}
 
-func withGzip(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next.ServeHTTP(w, r)
-			return
+	var notFound []byte
+	if cfg.NotFoundPage != "" {
+		var err error
+		if notFound, err = os.ReadFile(cfg.NotFoundPage); err != nil {
+			return nil, nil, fmt.Errorf("notfound-page: %w", err)
+		}
+	}
+
+	robots := defaultRobots
+	switch cfg.Robots {
+	case "off":
+		robots = nil
+	case "":
+	default:
+		if robots, err = os.ReadFile(cfg.Robots); err != nil {
+			return nil, nil, fmt.Errorf("robots: %w", err)
 		}
+	}
 
-		ext := strings.ToLower(filepath.Ext(r.URL.Path))
-		if ext != ".tsv" && ext != ".html" && ext != ".js" && ext != ".css" {
-			next.ServeHTTP(w, r)
-			return
+	favicon := defaultFavicon
+	switch cfg.Favicon {
+	case "off":
+		favicon = nil
+	case "":
+	default:
+		if favicon, err = os.ReadFile(cfg.Favicon); err != nil {
+			return nil, nil, fmt.Errorf("favicon: %w", err)
 		}
+	}
 
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Add("Vary", "Accept-Encoding")
+	// The compression limit protects the CPU, so all mounts share it.
+	var limit *encodeLimit
+	if cfg.GzipConcurrency > 0 {
+		limit = newEncodeLimit(cfg.GzipConcurrency, cfg.GzipWait)
+	}
 
-		gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	mux := http.NewServeMux()
+	var roots []http.FileSystem
+	for _, mnt := range cfg.mounts() {
+		var root http.FileSystem = http.Dir(mnt.Dir)
+		switch {
+		case mnt.Dir == embeddedDir:
+			root, _ = embeddedFS()
+		case !cfg.FollowSymlinks:
+			root = rootedFS{root, mnt.Dir}
+		}
+		roots = append(roots, root)
+		h, err := staticHandler(cfg, mnt.Dir, root, notFound, limit, m)
 		if err != nil {
-			next.ServeHTTP(w, r)
-			return
+			return nil, nil, err
+		}
+		if mnt.Prefix == "/" {
+			mux.Handle("/", h)
+			if robots != nil {
+				mux.Handle("/robots.txt", withRobots(safeFS{root}, robots, h))
+			}
+			if favicon != nil {
+				mux.Handle("/favicon.ico", withFavicon(safeFS{root}, favicon, h))
+			}
+			continue
 		}
-		defer gz.Close()
+		prefix := strings.TrimSuffix(mnt.Prefix, "/")
+		mux.Handle(prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently))
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, h))
+	}
+
+	handler = withCleanPath(withDownload(mux))
+	handler = withReadOnly(handler)
+	handler = withSecurityHeaders(cfg.CSP, handler)
+	creds, err := cfg.credentials()
+	if err != nil {
+		return nil, nil, err
+	}
+	if creds != nil {
+		handler = withBasicAuth(creds, handler)
+	}
+	if cfg.CORS {
+		handler = withCORS(corsOptions{
+			Origins: cfg.CORSOrigins,
+			Methods: cfg.CORSMethods,
+			Headers: cfg.CORSHeaders,
+			Expose:  cfg.CORSExpose,
+			MaxAge:  cfg.CORSMaxAge,
+
+			Credentials: cfg.CORSCredentials,
+		}, handler)
+	}
+	if cfg.RateLimit > 0 {
+		lim.configure(cfg.RateLimit, cfg.RateBurst)
+		handler = withRateLimit(lim, cfg.trustedProxies, handler)
+	}
+	ops := make(map[string]http.Handler)
+	if cfg.MetricsPath != "" {
+		handler = m.wrap(handler)
+		ops[cfg.MetricsPath] = m.handler()
+	}
+	if cfg.AccessLog {
+		handler = withAccessLog(cfg.LogFormat, cfg.LogSkip, cfg.LogCache, cfg.trustedProxies, handler)
+	}
 
-		next.ServeHTTP(gzipResponseWriter{ResponseWriter: w, w: gz}, r)
-	})
+	if cfg.HealthPath != "" {
+		ops[cfg.HealthPath] = healthHandler(roots)
+	}
+	if cfg.VersionPath != "" {
+		ops[cfg.VersionPath] = versionHandler()
+	}
+
+	// With an admin listener the operational endpoints move there, leaving
+	// the main one to serve only content.
+	if cfg.AdminAddr != "" {
+		var admin http.Handler = http.NotFoundHandler()
+		if cfg.Pprof {
+			admin = withPrefixRoute(pprofPrefix, pprofHandler(), admin)
+		}
+		admin = withErrorFormat(cfg.ErrorFormat, withRoutes(ops, admin))
+		return withErrorFormat(cfg.ErrorFormat, handler), admin, nil
+	}
+	handler = withRoutes(ops, handler)
+	if cfg.Pprof {
+		// Profiles expose internals, so they stay behind the same
+		// credentials as the files.
+		var profiles http.Handler = pprofHandler()
+		if creds != nil {
+			profiles = withBasicAuth(creds, profiles)
+		}
+		handler = withPrefixRoute(pprofPrefix, profiles, handler)
+	}
+	return withErrorFormat(cfg.ErrorFormat, handler), nil, nil
 }
 
-func main() {
-	var dir string
-	var addr string
-	flag.StringVar(&dir, "dir", "../dist", "directory to serve")
-	flag.StringVar(&addr, "addr", "127.0.0.1:8787", "listen address")
-	flag.Parse()
+// staticHandler serves the files in root with compression, cache hints and
+// the optional SPA fallback applied. Paths are relative to the mount point.
+// dir is the directory behind root, or embeddedDir. limit, if not nil,
+// bounds the compressions running at once. m counts the compressed cache's
+// hits and misses when metrics are enabled.
+func staticHandler(cfg *Config, dir string, root http.FileSystem, notFound []byte, limit *encodeLimit, m *metrics) (http.Handler, error) {
+	root = safeFS{root}
+	if cfg.AtomicReads && dir != embeddedDir {
+		root = stableFS{root}
+	}
+	base := root
+	if err := validateRegistry(cfg.Validate, base, "/registry.tsv"); err != nil {
+		return nil, err
+	}
+	var alias *snapshotAlias
+	if cfg.SnapshotAlias {
+		alias = newSnapshotAlias(base, "/registry.tsv")
+		root = snapshotFS{root, alias}
+	}
+	if !cfg.Dotfiles {
+		root = noDotfilesFS{root}
+	}
+	if cfg.MaxFileSize > 0 {
+		root = maxSizeFS{root, cfg.MaxFileSize}
+	}
+	if !slices.Equal(cfg.IndexFiles, []string{"index.html"}) {
+		root = indexFS{root, cfg.IndexFiles}
+	}
+	if cfg.NoDirListing {
+		root = noListingFS{root}
+	}
+	copts := compressOptions{
+		Encodings: cfg.Compression,
+		Exts:      cfg.GzipExt,
+		Types:     cfg.GzipTypes,
+		DenyExts:  cfg.gzipDenyExts,
+		DenyTypes: cfg.gzipDenyTypes,
+		GzipLevel: int(cfg.GzipLevel),
+		ExtLevels: cfg.gzipExtLevels,
+		MinSize:   cfg.GzipMinSize,
+		FlushSize: cfg.GzipFlushSize,
+		SniffSize: cfg.GzipSniffSize,
+		Debug:     cfg.DebugHeaders,
 
-	_ = mime.AddExtensionType(".tsv", "text/tab-separated-values; charset=utf-8")
+		Precompressed: cfg.Precompressed,
+		Limit:         limit,
+	}
+	if cfg.CacheSize > 0 {
+		copts.Cache = newEncodedCache(cfg.CacheSize, cfg.CacheMaxFile)
+	}
+	if cfg.MetricsPath != "" {
+		copts.Metrics = m
+	}
+	sums := newSumCache()
+	if cfg.DigestHeader {
+		copts.Digests = sums
+	}
+	files, index := countBody(http.FileServer(root)), countBody(serveFile(root, "/index.html"))
+	if cfg.DigestHeader {
+		files = withDigest(root, sums, files)
+	}
+	if cfg.DefaultType != "" || cfg.NoExtType != "" {
+		files = withDefaultContentType(cfg.DefaultType, cfg.NoExtType, files)
+	}
+	if cfg.AtomicReads {
+		files, index = withRetryLater(files), withRetryLater(index)
+	}
+	if notFound != nil {
+		files, index = withNotFoundPage(notFound, files), withNotFoundPage(notFound, index)
+	}
 
-	fs := http.FileServer(http.Dir(dir))
+	static := withCompression(copts, root, files)
+	if cfg.SPAFallback {
+		index := withCompression(copts, root, index)
+		static = withSPAFallback(root, cfg.SPABypass, index, static)
+	}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	static = withETag(root, copts.hasVariants, static)
+	if cfg.Checksums {
+		static = withChecksums(root, sums, static)
+	}
+	if cfg.StaticTimeout > 0 {
+		static = withWriteDeadline(cfg.StaticTimeout, static)
+	}
 
-		// Cache hints
-		if strings.HasPrefix(r.URL.Path, "/registry.") && strings.HasSuffix(r.URL.Path, ".tsv") {
-			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-		} else if r.URL.Path == "/registry.tsv" {
-			w.Header().Set("Cache-Control", "public, max-age=60")
+	dynamic := make(map[string]http.Handler)
+	if cfg.IndexPath != "" {
+		dynamic[cfg.IndexPath] = newRegistryIndex(base, alias, cfg.IndexTTL)
+	}
+	if alias != nil {
+		dynamic["/registry.current"] = alias
+	}
+	if cfg.JSONPath != "" {
+		dynamic[cfg.JSONPath] = withCoalescing(cfg.RequestTimeout, registryJSON{root, "/registry.tsv", cfg.RaggedRows == "pad", cfg.JSONMaxLimit})
+	}
+	if cfg.MetaPath != "" {
+		dynamic[cfg.MetaPath] = newRegistryMeta(root, "/registry.tsv")
+	}
+	if cfg.DiffPath != "" {
+		dynamic[cfg.DiffPath] = withCoalescing(cfg.RequestTimeout, registryDiff{root, cfg.DiffKey, cfg.RaggedRows == "pad", cfg.DiffMaxSize})
+	}
+	// Dynamic responses are not files, so they bypass the encoded cache
+	// and precompressed copies.
+	dopts := copts
+	dopts.Cache, dopts.Precompressed, dopts.Digests = nil, nil, nil
+	for p, h := range dynamic {
+		h = withCompression(dopts, root, countBody(h))
+		// Each caller's deadline only ends its own wait; a coalesced run
+		// is bounded by the same timeout of its own.
+		if cfg.RequestTimeout > 0 {
+			h = withTimeout(cfg.RequestTimeout, h)
 		}
+		dynamic[p] = h
+	}
+	// The event stream stays out of compression, which would hold back
+	// its small writes.
+	if cfg.EventsPath != "" && dir != embeddedDir {
+		dynamic[cfg.EventsPath] = newRegistryEvents(dir, "registry.tsv")
+	}
+	if cfg.AutoIndex {
+		index := withCompression(dopts, root, countBody(newAutoIndex(base, cfg.IndexTTL)))
+		static = withAutoIndex(root, index, static)
+	}
+	static = withRoutes(dynamic, static)
 
-		fs.ServeHTTP(w, r)
-	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The cache rules are for files. A generated response gets the
+		// dynamic policy even where a rule's pattern would match its path.
+		cc := cfg.DynamicCache
+		if _, ok := dynamic[r.URL.Path]; !ok {
+			cc = cacheControlFor(cfg.cacheRules, r.URL.Path)
+		}
+		if cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
 
-	fmt.Printf("Serving %s at http://%s\n", dir, addr)
-	log.Fatal(http.ListenAndServe(addr, withGzip(handler)))
+		static.ServeHTTP(w, r)
+	}), nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates files, keyed by slash-separated path, in a fresh
+// temporary directory and returns it.
+func writeFiles(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// newTestHandler serves files through buildHandler with the default
+// configuration, as changed by configure when it is not nil.
+func newTestHandler(t testing.TB, files map[string]string, configure func(*Config)) http.Handler {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Dir = writeFiles(t, files)
+	cfg.AccessLog = false
+	if configure != nil {
+		configure(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := buildHandler(&cfg, newMetrics(), newIPLimiter(cfg.RateLimit, cfg.RateBurst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// get sends a GET for target through h with the given header name and
+// value pairs.
+func get(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
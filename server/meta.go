@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// registryMetadata summarizes a registry file for /registry.meta.json.
+type registryMetadata struct {
+	Name    string    `json:"name"`
+	Columns []string  `json:"columns"`
+	Rows    int       `json:"rows"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// metaEntry is an encoded registryMetadata along with the file state it
+// was computed for.
+type metaEntry struct {
+	size int64
+	mod  time.Time
+	body []byte
+}
+
+// registryMeta describes the registry file, or with ?hash= one of its
+// snapshots, without sending its rows: the header columns, the number of
+// rows after it, the size and the mtime. Each file is read once and then
+// served from memory until its size or mtime changes.
+type registryMeta struct {
+	root http.FileSystem
+	name string
+
+	mu      sync.Mutex
+	entries map[string]metaEntry
+}
+
+func newRegistryMeta(root http.FileSystem, name string) *registryMeta {
+	return &registryMeta{root: root, name: name, entries: make(map[string]metaEntry)}
+}
+
+func (m *registryMeta) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := m.name
+	if hash := r.URL.Query().Get("hash"); hash != "" {
+		if name = snapshotName(hash); name == "" {
+			httpError(w, r, "hash must be a snapshot hash", http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, err := m.root.Open(name)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		notFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	e, ok := m.entries[name]
+	m.mu.Unlock()
+	if !ok || e.size != fi.Size() || !e.mod.Equal(fi.ModTime()) {
+		meta := registryMetadata{Name: name, Columns: []string{}, Size: fi.Size(), ModTime: fi.ModTime().UTC()}
+		t := newTSVReader(f)
+		header, err := t.next()
+		if err == nil {
+			meta.Columns = header
+			for _, err = t.next(); err == nil; _, err = t.next() {
+				meta.Rows++
+			}
+		}
+		if err != io.EOF {
+			log.Printf("%s: %v", name, err)
+			httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		body, _ := json.Marshal(meta)
+		e = metaEntry{fi.Size(), fi.ModTime(), append(body, '\n')}
+		m.mu.Lock()
+		m.entries[name] = e
+		m.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, r, e.body)
+}
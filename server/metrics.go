@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors for served requests.
+type metrics struct {
+	reg      *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration prometheus.Histogram
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+
+	cacheLookups *prometheus.CounterVec
+	cacheSaved   *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		reg: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_http_requests_total",
+			Help: "Requests served, by status code and content encoding.",
+		}, []string{"status", "encoding"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "registry_http_request_duration_seconds",
+			Help:    "Time taken to serve a request.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "registry_http_response_body_bytes_total",
+			Help: "Response body bytes produced before compression.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "registry_http_response_sent_bytes_total",
+			Help: "Response body bytes sent to clients after compression.",
+		}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_compressed_cache_lookups_total",
+			Help: "Lookups of compressed copies, by source (cache or sidecar) and result (hit or miss).",
+		}, []string{"source", "result"}),
+		cacheSaved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "registry_compressed_cache_saved_bytes_total",
+			Help: "Bytes left unsent by serving compressed copies from the cache or sidecars, by source.",
+		}, []string{"source"}),
+	}
+	m.reg.MustRegister(
+		m.requests, m.duration, m.bytesIn, m.bytesOut,
+		m.cacheLookups, m.cacheSaved,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+}
+
+type bodyBytesKey struct{}
+
+// wrap records every request passing through it. It should wrap the
+// compression middleware, so it sees the bytes actually sent; countBody
+// reports the uncompressed size from further in.
+func (m *metrics) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var body int64
+		r = r.WithContext(context.WithValue(r.Context(), bodyBytesKey{}, &body))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		enc := rec.Header().Get("Content-Encoding")
+		if enc == "" {
+			enc = "identity"
+		}
+		m.requests.WithLabelValues(strconv.Itoa(rec.status), enc).Inc()
+		m.duration.Observe(time.Since(start).Seconds())
+		m.bytesIn.Add(float64(body))
+		m.bytesOut.Add(float64(rec.bytes))
+	})
+}
+
+// countBody reports the body bytes next writes, before any compression
+// applied around it, to the metrics middleware.
+func countBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(bodyBytesKey{}).(*int64); !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		addBodyBytes(r.Context(), rec.bytes)
+	})
+}
+
+// addBodyBytes adds n to the uncompressed body size of the request in ctx.
+func addBodyBytes(ctx context.Context, n int64) {
+	if body, ok := ctx.Value(bodyBytesKey{}).(*int64); ok {
+		*body += n
+	}
+}
+
+// cacheLookup counts a lookup of a compressed copy from source, cache or
+// sidecar, with result hit or miss, and the bytes a hit saved over sending
+// the file uncompressed. The outcome also goes to the access log of the
+// request in ctx when -access-log-cache is on. A nil *metrics counts
+// nothing but still notes the outcome.
+func (m *metrics) cacheLookup(ctx context.Context, source, result string, saved int64) {
+	noteCache(ctx, source, result)
+	if m == nil {
+		return
+	}
+	m.cacheLookups.WithLabelValues(source, result).Inc()
+	if saved > 0 {
+		m.cacheSaved.WithLabelValues(source).Add(float64(saved))
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withReadOnly rejects every method other than GET and HEAD with 405.
+func withReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			httpError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// notFoundWriter replaces the body of a 404 response with page.
+type notFoundWriter struct {
+	http.ResponseWriter
+	page     []byte
+	replaced bool
+}
+
+func (n *notFoundWriter) WriteHeader(code int) {
+	if code != http.StatusNotFound || n.replaced {
+		n.ResponseWriter.WriteHeader(code)
+		return
+	}
+	n.replaced = true
+	h := n.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(n.page)))
+	n.ResponseWriter.WriteHeader(code)
+	n.ResponseWriter.Write(n.page)
+}
+
+func (n *notFoundWriter) Write(b []byte) (int, error) {
+	if n.replaced {
+		return len(b), nil
+	}
+	return n.ResponseWriter.Write(b)
+}
+
+func (n *notFoundWriter) Unwrap() http.ResponseWriter { return n.ResponseWriter }
+
+// withNotFoundPage serves page as the body of every 404 from next.
+func withNotFoundPage(page []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&notFoundWriter{ResponseWriter: w, page: page}, r)
+	})
+}
+
+// cspWriter adds a Content-Security-Policy header to HTML responses.
+type cspWriter struct {
+	http.ResponseWriter
+	csp         string
+	wroteHeader bool
+}
+
+func (c *cspWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if strings.HasPrefix(c.Header().Get("Content-Type"), "text/html") {
+			c.Header().Set("Content-Security-Policy", c.csp)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cspWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *cspWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *cspWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// withSecurityHeaders sets hardening headers on every response, plus csp as
+// the Content-Security-Policy of HTML responses when it is non-empty.
+func withSecurityHeaders(csp string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		if csp != "" {
+			w = &cspWriter{ResponseWriter: w, csp: csp}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCleanPath redirects requests for non-canonical paths, such as //a or
+// /a/../b, to their path.Clean form with a 301. A trailing slash is kept.
+// Paths whose .. segments climb above the root, even percent-encoded as in
+// /%2e%2e/secret, are answered with 400 instead.
+func withCleanPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if escapesRoot(p) || strings.ContainsRune(p, 0) {
+			httpError(w, r, "invalid path", http.StatusBadRequest)
+			return
+		}
+		clean := path.Clean("/" + p)
+		if strings.HasSuffix(p, "/") && clean != "/" {
+			clean += "/"
+		}
+		if clean != p {
+			u := *r.URL
+			u.Path, u.RawPath = clean, ""
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// escapesRoot reports whether the .. segments of p lead above its root.
+// Backslashes count as separators, as they do for files on Windows.
+func escapesRoot(p string) bool {
+	depth := 0
+	for _, seg := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch seg {
+		case ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// downloadWriter marks successful responses as attachments named filename.
+type downloadWriter struct {
+	http.ResponseWriter
+	filename    string
+	wroteHeader bool
+}
+
+func (d *downloadWriter) WriteHeader(code int) {
+	if !d.wroteHeader {
+		d.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusPartialContent {
+			d.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.filename}))
+		}
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *downloadWriter) Write(b []byte) (int, error) {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	return d.ResponseWriter.Write(b)
+}
+
+func (d *downloadWriter) Flush() {
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (d *downloadWriter) Unwrap() http.ResponseWriter { return d.ResponseWriter }
+
+// withDownload makes browsers save a file instead of displaying it when it
+// is requested with ?download=1. The filename is that of the requested
+// path, so a compressed transfer of /registry.tsv still saves as
+// registry.tsv.
+func withDownload(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("download") == "1" && !strings.HasSuffix(r.URL.Path, "/") {
+			w = &downloadWriter{ResponseWriter: w, filename: path.Base(r.URL.Path)}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withWriteDeadline gives each response from next d to be written in full,
+// in place of the server's -write-timeout, so that large downloads can be
+// allowed longer than everything else.
+func withWriteDeadline(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contentTypeWriter replaces the Content-Type of successful responses that
+// have none or only the generic application/octet-stream with fallback, or
+// with force for every file without an extension.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	fallback    string
+	force       string
+	wroteHeader bool
+}
+
+func (c *contentTypeWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if code == http.StatusOK || code == http.StatusPartialContent {
+			h := c.Header()
+			ct, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+			switch {
+			case c.force != "":
+				h.Set("Content-Type", c.force)
+			case c.fallback != "" && (ct == "" || ct == "application/octet-stream"):
+				h.Set("Content-Type", c.fallback)
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *contentTypeWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *contentTypeWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *contentTypeWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+// withDefaultContentType applies fallback as the Content-Type of files that
+// the file server could only label application/octet-stream, and force as
+// that of every file whose name has no extension. Either may be empty.
+func withDefaultContentType(fallback, force string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &contentTypeWriter{ResponseWriter: w, fallback: fallback}
+		if p := r.URL.Path; !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			cw.force = force
+		}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// timeoutWriter passes a response through until ctx is done. After that,
+// a response that has not started is dropped so that withTimeout can answer
+// 503 in its place, and one under way is refused further writes.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	dropped     bool
+	cut         bool
+}
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	if t.wroteHeader || t.dropped {
+		return
+	}
+	if t.ctx.Err() != nil {
+		t.dropped = true
+		return
+	}
+	t.wroteHeader = true
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	if err := t.ctx.Err(); err != nil {
+		t.cut = t.wroteHeader
+		return 0, err
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *timeoutWriter) Flush() {
+	if !t.dropped {
+		if f, ok := t.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (t *timeoutWriter) Unwrap() http.ResponseWriter { return t.ResponseWriter }
+
+// withTimeout cancels the context of requests through next after d and
+// answers 503 when next had not started its response by then. Unlike
+// http.TimeoutHandler, it does not hold the response in memory, so next
+// still streams and can flush. A response cut short by the deadline is
+// aborted so that the client sees it truncated.
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		outer := w.Header().Clone()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		defer func() {
+			// next may abort once it sees the context done; before the
+			// response has started that is still a clean 503.
+			if p := recover(); p != nil && (p != http.ErrAbortHandler || tw.wroteHeader) {
+				panic(p)
+			}
+			if ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+			if tw.cut {
+				panic(http.ErrAbortHandler)
+			}
+			if !tw.wroteHeader {
+				h := w.Header()
+				clear(h)
+				for k, v := range outer {
+					h[k] = v
+				}
+				httpError(w, r, "request timed out", http.StatusServiceUnavailable)
+			}
+		}()
+		next.ServeHTTP(tw, r.WithContext(ctx))
+	})
+}
+
+// writeBody sends body as a complete response with its Content-Length, or
+// only the headers for HEAD.
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"testing"
+)
+
+func TestCleanPathTraversal(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"sub/file": "x", "secret": "s"}, nil)
+	for _, target := range []string{
+		"/../etc/passwd",
+		"/%2e%2e/secret",
+		"/sub/..%2f..%2fsecret",
+	} {
+		if w := get(h, target); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSafeFS(t *testing.T) {
+	root := safeFS{http.Dir(writeFiles(t, map[string]string{"a": "x"}))}
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{"/a", true},
+		{"/", true},
+		{"a", false},
+		{"/../a", false},
+		{"/sub/../a", false},
+		{`/..\a`, false},
+		{"/a\x00", false},
+	} {
+		f, err := root.Open(tt.name)
+		if err == nil {
+			f.Close()
+		}
+		if tt.ok != (err == nil) {
+			t.Errorf("Open(%q): %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q): %v, want fs.ErrNotExist", tt.name, err)
+		}
+	}
+}
+
+func TestCanonicalRedirects(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"a": "x", "b": "y", "dir/index.html": "<p>dir</p>"}, nil)
+	for _, tt := range []struct {
+		target, location string
+	}{
+		{"//a", "/a"},
+		{"/a/../b", "/b"},
+		{"/dir", "dir/"}, // the file server's relative form of /dir/
+	} {
+		w := get(h, tt.target)
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, http.StatusMovedPermanently)
+			continue
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("GET %s: Location %q, want %q", tt.target, loc, tt.location)
+		}
+	}
+}
+
+func TestDownloadDisposition(t *testing.T) {
+	h := newTestHandler(t, map[string]string{"registry.tsv": testRegistry(200)}, nil)
+	for _, tt := range []struct {
+		target, accept, want string
+	}{
+		{"/registry.tsv", "", ""},
+		{"/registry.tsv?download=0", "", ""},
+		{"/registry.tsv?download=1", "", `attachment; filename=registry.tsv`},
+		{"/registry.tsv?download=1", "gzip", `attachment; filename=registry.tsv`},
+	} {
+		w := get(h, tt.target, "Accept-Encoding", tt.accept)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d", tt.target, w.Code)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != tt.want {
+			t.Errorf("GET %s (Accept-Encoding %q): Content-Disposition %q, want %q", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strings"
+)
+
+// registerMIME registers the .ext=type pairs in types and the entries of
+// the mime.types style file at path, if any, logging each registration.
+func registerMIME(types []string, path string) error {
+	pairs := make([][2]string, 0, len(types))
+	for _, t := range types {
+		ext, typ, ok := strings.Cut(t, "=")
+		if !ok || !strings.HasPrefix(ext, ".") || typ == "" {
+			return fmt.Errorf("mime: %q must have the form .ext=type", t)
+		}
+		pairs = append(pairs, [2]string{ext, typ})
+	}
+
+	if path != "" {
+		filePairs, err := readMIMEFile(path)
+		if err != nil {
+			return fmt.Errorf("mime-file: %w", err)
+		}
+		// Flags take precedence, so register the file first.
+		pairs = append(filePairs, pairs...)
+	}
+
+	for _, p := range pairs {
+		if err := mime.AddExtensionType(p[0], p[1]); err != nil {
+			return fmt.Errorf("mime: %s: %w", p[0], err)
+		}
+		log.Printf("mime: %s -> %s", p[0], p[1])
+	}
+	return nil
+}
+
+// readMIMEFile parses lines of the form "type ext1 ext2 ...", as found in
+// /etc/mime.types. Extensions may be written with or without the dot.
+func readMIMEFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pairs [][2]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			pairs = append(pairs, [2]string{"." + strings.TrimPrefix(ext, "."), fields[0]})
+		}
+	}
+	return pairs, sc.Err()
+}
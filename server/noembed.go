@@ -0,0 +1,8 @@
+//go:build !embed
+
+package main
+
+import "net/http"
+
+// embeddedFS reports that this binary was built without the embed tag.
+func embeddedFS() (http.FileSystem, bool) { return nil, false }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// withRoutes serves the handlers in routes, matched by exact path, ahead of
+// next. Operational endpoints are routed this way in front of the whole
+// stack, so they bypass its logging and compression.
+func withRoutes(routes map[string]http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := routes[r.URL.Path]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pprofPrefix is where the runtime profiles are served by -pprof.
+const pprofPrefix = "/debug/pprof/"
+
+// pprofHandler serves the net/http/pprof endpoints under pprofPrefix.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofPrefix, pprof.Index)
+	mux.HandleFunc(pprofPrefix+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofPrefix+"profile", pprof.Profile)
+	mux.HandleFunc(pprofPrefix+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofPrefix+"trace", pprof.Trace)
+	return mux
+}
+
+// withPrefixRoute serves every path under prefix with h, ahead of next.
+func withPrefixRoute(prefix string, h, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthHandler answers liveness probes with "ok", or 503 when one of roots
+// can no longer be read.
+func healthHandler(roots []http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, root := range roots {
+			f, err := root.Open("/")
+			if err == nil {
+				_, err = f.Stat()
+				f.Close()
+			}
+			if err != nil {
+				log.Printf("health check: %v", err)
+				httpError(w, r, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the user and group named by name
+// and group, each either a name or a numeric id. An empty group means the
+// user's primary group. It must run after the listeners are bound, which
+// may need root for ports below 1024, and before anything is served, so no
+// request is ever handled with the original privileges.
+func dropPrivileges(name, group string) error {
+	uid, primary, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	gid := primary
+	if group != "" {
+		if gid, err = lookupGroup(group); err != nil {
+			return err
+		}
+	} else if gid < 0 {
+		return fmt.Errorf("user: uid %d has no passwd entry to take a primary group from; set -group", uid)
+	}
+
+	// The group has to go first: once the uid changes, the process is no
+	// longer allowed to change it.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	return nil
+}
+
+// lookupUser returns the uid for s and the primary gid from its passwd
+// entry. A numeric s is taken as the uid as is, since containers often run
+// ids with no passwd entry; the gid is then -1 when there is none.
+func lookupUser(s string) (uid, gid int, err error) {
+	var u *user.User
+	if n, convErr := strconv.Atoi(s); convErr == nil {
+		u, err = user.LookupId(s)
+		if err != nil {
+			return n, -1, nil
+		}
+	} else if u, err = user.Lookup(s); err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("user: uid %q is not numeric", u.Uid)
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, fmt.Errorf("user: gid %q is not numeric", u.Gid)
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup returns the gid for s, taking a numeric s as the gid as is.
+func lookupGroup(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("group: gid %q is not numeric", g.Gid)
+	}
+	return gid, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// dropPrivileges reports that -user and -group need Linux.
+func dropPrivileges(name, group string) error {
+	return errors.New("user and group: dropping privileges is only supported on Linux")
+}
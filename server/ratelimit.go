@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTTL is how long a client's limiter survives without requests.
+const limiterIdleTTL = 3 * time.Minute
+
+// ipLimiter holds a token bucket per client IP and forgets idle clients.
+// Its sweeper runs for the life of the process, so one is made in main and
+// kept across reloads.
+type ipLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+func newIPLimiter(perSecond float64, burst int) *ipLimiter {
+	l := &ipLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+	go l.sweep()
+	return l
+}
+
+// configure sets the rate and burst allowed per client. Clients already
+// tracked keep their buckets and the tokens left in them, so a reload does
+// not hand a throttled client a fresh burst.
+func (l *ipLimiter) configure(perSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := rate.Limit(perSecond)
+	if limit == l.limit && burst == l.burst {
+		return
+	}
+	l.limit, l.burst = limit, burst
+	for _, c := range l.clients {
+		c.lim.SetLimit(limit)
+		c.lim.SetBurst(burst)
+	}
+}
+
+// reserve takes a token for ip, returning how long the client must wait when
+// none is available.
+func (l *ipLimiter) reserve(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimiter{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.seen = now
+	l.mu.Unlock()
+
+	res := c.lim.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Second
+	}
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+// sweep periodically drops limiters that have been idle for limiterIdleTTL,
+// so the map only holds recently active clients.
+func (l *ipLimiter) sweep() {
+	for now := range time.Tick(limiterIdleTTL) {
+		l.mu.Lock()
+		for ip, c := range l.clients {
+			if now.Sub(c.seen) > limiterIdleTTL {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// withRateLimit answers 429 with Retry-After to clients over their limit.
+func withRateLimit(l *ipLimiter, proxies []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if delay := l.reserve(clientIP(r, proxies), time.Now()); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			httpError(w, r, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withMaxInFlight answers 503 with Retry-After once n requests are already
+// being served, rather than letting a burst pile up goroutines and memory.
+func withMaxInFlight(n int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// clientIP returns the address of the client behind r. The X-Forwarded-For
+// chain is only believed when the direct peer is one of proxies. It is then
+// walked from the right, past the hops appended by trusted proxies, and the
+// first untrusted hop is the client; anything further left could have been
+// made up by it. A malformed hop ends the walk at the proxy that passed it.
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trusted(host, proxies) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		host = addr.Unmap().String()
+		if !trusted(host, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+func trusted(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses CIDRs or bare IP addresses.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// swapHandler forwards to a handler that can be replaced while serving.
+// Requests already under way finish on the handler they started with.
+type swapHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func (s *swapHandler) set(h http.Handler) { s.h.Store(&h) }
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load()).ServeHTTP(w, r)
+}
+
+// restartKeys are settings of the listeners themselves, which a reload
+// cannot change.
+var restartKeys = []string{
+	"addr", "admin-addr", "socket-mode", "user", "group", "tls-cert", "tls-key", "redirect-addr", "autocert-domains", "autocert-cache",
+	"shutdown-timeout", "read-timeout", "write-timeout", "idle-timeout", "max-conns", "max-conns-mode", "log-file",
+}
+
+// reload rereads the configuration from the command line and -config file,
+// rebuilds the handler stack from it and swaps it into h, and the admin
+// handler, if one is served, into admin. This also rereads
+// and rehashes the registry files. It returns the configuration now in
+// effect: on any error that is still old, and the old handler keeps serving.
+func reload(old *Config, m *metrics, lim *ipLimiter, h, admin *swapHandler) *Config {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(log.Writer())
+	cfg, err := loadConfig(fs, os.Args[1:])
+	if err != nil {
+		log.Printf("reload: %v; keeping the previous configuration", err)
+		return old
+	}
+
+	// Listener settings keep their running values, so that the next reload
+	// reports them again.
+	var live, ignored []string
+	now, was := cfg.fieldsByKey(), old.fieldsByKey()
+	for _, key := range cfg.changedKeys(old) {
+		if !slices.Contains(restartKeys, key) {
+			live = append(live, key)
+			continue
+		}
+		ignored = append(ignored, key)
+		reflect.ValueOf(now[key]).Elem().Set(reflect.ValueOf(was[key]).Elem())
+	}
+	if len(ignored) > 0 {
+		log.Printf("reload: changes to %s need a restart", strings.Join(ignored, ", "))
+	}
+
+	next, nextAdmin, err := buildHandler(&cfg, m, lim)
+	if err != nil {
+		log.Printf("reload: %v; keeping the previous configuration", err)
+		return old
+	}
+	h.set(next)
+	if nextAdmin != nil {
+		admin.set(nextAdmin)
+	}
+	if len(live) == 0 {
+		log.Print("reload: done, configuration unchanged")
+	} else {
+		log.Printf("reload: done, changed %s", strings.Join(live, ", "))
+	}
+	return &cfg
+}
@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// defaultRobots is the robots.txt served when neither the directory nor
+// -robots provides one. It keeps crawlers away from the whole site.
+var defaultRobots = []byte("User-agent: *\nDisallow: /\n")
+
+// withRobots answers /robots.txt with body unless root has a robots.txt of
+// its own, which next then serves like any other file. The body is tiny,
+// so it goes out as is rather than through compression.
+func withRobots(root http.FileSystem, body []byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, err := root.Open("/robots.txt"); err == nil {
+			f.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeBody(w, r, body)
+	})
+}
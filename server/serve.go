@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/netutil"
+)
+
+// runner is an http.Server together with the call that starts it, such as
+// srv.ListenAndServe or a ListenAndServeTLS closure.
+type runner struct {
+	srv   *http.Server
+	start func() error
+}
+
+// listen opens a TCP listener for addr, or a Unix socket for an address of
+// the form unix:/path/to/sock. A stale socket file left by an earlier run is
+// removed first; the socket is unlinked again when the listener is closed.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// binder opens the listeners for one run of the server. If any address
+// fails to bind, mustListen closes the ones already bound before exiting,
+// so nothing is left half started.
+type binder struct {
+	mode  os.FileMode
+	bound []net.Listener
+}
+
+// mustListen is listen that exits on failure.
+func (b *binder) mustListen(addr string) net.Listener {
+	ln, err := listen(addr, b.mode)
+	if err != nil {
+		b.closeAll()
+		log.Fatalf("listen %s: %v", addr, err)
+	}
+	b.bound = append(b.bound, ln)
+	return ln
+}
+
+// closeAll closes every listener bound so far.
+func (b *binder) closeAll() {
+	for _, ln := range b.bound {
+		ln.Close()
+	}
+}
+
+// mustListenPublic is mustListen for a main address, capped at -max-conns
+// open connections in queue mode. Further connections wait in the kernel
+// backlog until one closes. An idle keep-alive connection holds its slot
+// until it closes, so a low -idle-timeout matters in this mode. The cap
+// applies to each address separately.
+func (c *Config) mustListenPublic(b *binder, addr string) net.Listener {
+	ln := b.mustListen(addr)
+	if c.MaxConns > 0 && c.MaxConnsMode == "queue" {
+		ln = netutil.LimitListener(ln, c.MaxConns)
+	}
+	return ln
+}
+
+// redirectToHTTPS answers every request with a 301 to the same path and
+// query over HTTPS. Any port in the Host header is replaced by port, or
+// dropped when that is the default 443.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			httpError(w, r, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+			host = "[" + host + "]" // bare IPv6 literal
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// shutdownKey is the context key under which newServer stores a channel
+// that is closed once the server starts shutting down.
+type shutdownKey struct{}
+
+// shuttingDown returns the channel closed when the server handling a
+// request with ctx starts shutting down; outside a server it is nil and
+// never ready. Shutdown waits for in-flight requests rather than cancelling
+// them, so a handler that would otherwise run forever needs this to stop.
+func shuttingDown(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(shutdownKey{}).(chan struct{})
+	return done
+}
+
+// newServer returns a server for addr with the configured timeouts.
+func (c *Config) newServer(addr string, h http.Handler) *http.Server {
+	done := make(chan struct{})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: c.ReadTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{}, done)
+		},
+	}
+	srv.RegisterOnShutdown(sync.OnceFunc(func() { close(done) }))
+	return srv
+}
+
+// reloadHooks run, in order, each time the process receives SIGHUP.
+var reloadHooks []func()
+
+// onReload registers fn to run on SIGHUP.
+func onReload(fn func()) {
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// serveUntilSignal starts every runner and blocks until one of them fails or
+// SIGINT/SIGTERM arrives. It then shuts all servers down, letting in-flight
+// requests finish for up to timeout. SIGHUP runs the reload hooks.
+func serveUntilSignal(runners []runner, timeout time.Duration) error {
+	errc := make(chan error, len(runners))
+	for _, r := range runners {
+		go func() {
+			if err := r.start(); !errors.Is(err, http.ErrServerClosed) {
+				errc <- err
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var serveErr error
+wait:
+	for {
+		select {
+		case <-hup:
+			log.Print("reload signal received")
+			for _, fn := range reloadHooks {
+				fn()
+			}
+		case serveErr = <-errc:
+			log.Printf("server error: %v", serveErr)
+			break wait
+		case <-ctx.Done():
+			log.Print("shutdown signal received")
+			break wait
+		}
+	}
+	stop()
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, r := range runners {
+		if err := r.srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown %s: %v", r.srv.Addr, err)
+		}
+	}
+	log.Print("shutdown complete")
+	return serveErr
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot is the content of the registry file at the time it was hashed.
+type snapshot struct {
+	hash string
+	data []byte
+	mod  time.Time
+}
+
+// snapshotAlias serves the registry file under a content-addressed name such
+// as /registry.75a56b48d617c730.tsv. The content is held in memory, so the
+// alias keeps serving exactly the bytes it was hashed from even after the
+// file on disk changes, until the next reload.
+type snapshotAlias struct {
+	root http.FileSystem
+	name string // e.g. /registry.tsv
+
+	mu  sync.RWMutex
+	cur *snapshot
+}
+
+func newSnapshotAlias(root http.FileSystem, name string) *snapshotAlias {
+	s := &snapshotAlias{root: root, name: name}
+	if err := s.reload(); err != nil {
+		log.Printf("snapshot %s: %v", name, err)
+	}
+	return s
+}
+
+// reload rereads and rehashes the registry file. When it cannot be read the
+// alias is withdrawn.
+func (s *snapshotAlias) reload() error {
+	snap, err := s.read()
+	s.mu.Lock()
+	s.cur = snap
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("snapshot %s is %s", s.name, s.path(snap))
+	return nil
+}
+
+func (s *snapshotAlias) read() (*snapshot, error) {
+	f, err := s.root.Open(s.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{hash: snapshotHash(data), data: data, mod: fi.ModTime()}, nil
+}
+
+// snapshotHash names the registry data the way scripts/build-registry.mjs
+// names its snapshots: by the version in a leading #v= line, or failing
+// that by the first 16 hex digits of the SHA-256 of the body below it. The
+// same content thus gets the same immutable URL whether the build script or
+// the alias published it.
+func snapshotHash(data []byte) string {
+	body := data
+	if line, rest, ok := bytes.Cut(data, []byte("\n")); ok {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "#v="); ok {
+			if snapshotName(v) != "" {
+				return v
+			}
+			body = rest
+		}
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:8])
+}
+
+// current returns the snapshot being served, or nil. A nil alias serves none.
+func (s *snapshotAlias) current() *snapshot {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur
+}
+
+// path returns the hashed name snap is served under.
+func (s *snapshotAlias) path(snap *snapshot) string {
+	return strings.TrimSuffix(s.name, ".tsv") + "." + snap.hash + ".tsv"
+}
+
+// ServeHTTP answers with the current hash, so that clients can pin to the
+// matching snapshot.
+func (s *snapshotAlias) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snap := s.current()
+	if snap == nil {
+		httpError(w, r, "no snapshot available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeBody(w, r, []byte(snap.hash+"\n"))
+}
+
+// snapshotName returns the path of the registry snapshot with the given
+// hash, or "" when hash is not a lowercase hex string.
+func snapshotName(hash string) string {
+	if hash == "" || strings.Trim(hash, "0123456789abcdef") != "" {
+		return ""
+	}
+	return "/registry." + hash + ".tsv"
+}
+
+// snapshotFS adds the hashed alias of the registry file to a FileSystem.
+// A snapshot file of that name already on disk, as the build script writes
+// one, is served in its place.
+type snapshotFS struct {
+	http.FileSystem
+	alias *snapshotAlias
+}
+
+func (s snapshotFS) Open(name string) (http.File, error) {
+	f, err := s.FileSystem.Open(name)
+	if snap := s.alias.current(); err != nil && snap != nil && name == s.alias.path(snap) {
+		return &memFile{bytes.NewReader(snap.data), memFileInfo{name, snap}}, nil
+	}
+	return f, err
+}
+
+// memFile is a read-only http.File over contents held in memory, such as a
+// snapshot.
+type memFile struct {
+	*bytes.Reader
+	fi fs.FileInfo
+}
+
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+func (f *memFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+type memFileInfo struct {
+	name string
+	snap *snapshot
+}
+
+func (i memFileInfo) Name() string       { return path.Base(i.name) }
+func (i memFileInfo) Size() int64        { return int64(len(i.snap.data)) }
+func (i memFileInfo) Mode() fs.FileMode  { return 0o444 }
+func (i memFileInfo) ModTime() time.Time { return i.snap.mod }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// withSPAFallback answers requests for extensionless paths that don't exist
+// under root with fallback instead of a 404, so client-side routes of a
+// single-page app resolve to index.html. Paths with an extension are treated
+// as assets and still 404 when missing, and paths under any of bypass are
+// never rewritten.
+func withSPAFallback(root http.FileSystem, bypass []string, fallback, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if path.Ext(p) != "" || hasAnyPrefix(p, bypass) || exists(root, p) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/index.html"
+		fallback.ServeHTTP(w, r2)
+	})
+}
+
+// serveFile serves name from root, bypassing http.FileServer's redirect of
+// index.html requests to their directory.
+func serveFile(root http.FileSystem, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := root.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+	})
+}
+
+func exists(root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
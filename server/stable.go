@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+// errFileChanging reports a file that changed while it was being read.
+var errFileChanging = errors.New("file changed while being read")
+
+// stableFS guards against files rewritten in place while they are read.
+// Every read of a regular file checks that its size and modification time
+// are still those it was opened with, and fails with errFileChanging once
+// they are not. A response is then cut short rather than end quietly with a
+// mix of old and new contents, and nothing built on top, such as a cache or
+// the registry snapshot, takes half a file for a whole one. The checks cost
+// a stat per read, so nothing is held in memory and opening a file several
+// times for one request stays cheap.
+//
+// Publishing a file by writing a temporary copy and renaming it over the
+// old one needs none of this, since an open file keeps the contents it was
+// opened with. That is the supported way to update the served directory.
+type stableFS struct {
+	http.FileSystem
+}
+
+func (s stableFS) Open(name string) (http.File, error) {
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	return &stableFile{File: f, fi: fi}, nil
+}
+
+// sameFile reports whether a and b describe the same contents of a file, as
+// far as its size and modification time tell.
+func sameFile(a, b fs.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// stableFile is a regular file opened by stableFS. Each read checks that
+// the file is still as it was when opened and fails with errFileChanging
+// once it is not.
+type stableFile struct {
+	http.File
+	fi fs.FileInfo
+}
+
+func (f *stableFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	if now, statErr := f.File.Stat(); statErr != nil || !sameFile(f.fi, now) {
+		return n, errFileChanging
+	}
+	return n, err
+}
+
+// Seek checks the file as Read does. The file server seeks before it sends
+// the headers of a range or of a sniffed type, so a change caught here can
+// still be answered with an error status.
+func (f *stableFile) Seek(offset int64, whence int) (int64, error) {
+	if now, err := f.File.Stat(); err != nil || !sameFile(f.fi, now) {
+		return 0, errFileChanging
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *stableFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+
+// retryLaterWriter turns a 500 from the file server into a 503 with
+// Retry-After. With stableFS underneath, a 500 almost always means a file
+// that changed before its response started, which a client can simply ask
+// for again.
+type retryLaterWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (rw *retryLaterWriter) WriteHeader(code int) {
+	if code != http.StatusInternalServerError || rw.replaced {
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rw.replaced = true
+	rw.Header().Set("Retry-After", "1")
+	httpError(rw.ResponseWriter, rw.r, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+func (rw *retryLaterWriter) Write(b []byte) (int, error) {
+	if rw.replaced {
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *retryLaterWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// withRetryLater answers with 503 and Retry-After where next would fail
+// with 500.
+func withRetryLater(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&retryLaterWriter{ResponseWriter: w, r: r}, r)
+	})
+}
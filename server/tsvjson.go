@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tsvReader reads rows from a registry file. Comment lines beginning with #,
+// such as the #v= version line, are skipped; the first other row is the
+// header.
+type tsvReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func newTSVReader(r io.Reader) *tsvReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	return &tsvReader{s: s}
+}
+
+// next returns the cells of the next row, or io.EOF after the last.
+func (t *tsvReader) next() ([]string, error) {
+	for t.s.Scan() {
+		t.line++
+		row := strings.TrimSuffix(t.s.Text(), "\r")
+		if row == "" || strings.HasPrefix(row, "#") {
+			continue
+		}
+		return strings.Split(row, "\t"), nil
+	}
+	if err := t.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// fitRow returns row with exactly n cells. With pad set, missing cells are
+// empty and extra cells dropped; otherwise a ragged row is an error.
+func fitRow(row []string, n int, pad bool) ([]string, error) {
+	switch {
+	case len(row) == n:
+		return row, nil
+	case !pad:
+		return nil, fmt.Errorf("row has %d cells, header has %d", len(row), n)
+	case len(row) > n:
+		return row[:n], nil
+	}
+	return append(row, make([]string, n-len(row))...), nil
+}
+
+// registryJSON streams the registry file as a JSON array of objects keyed by
+// the header row, in column order, optionally keeping only the rows that
+// match a filter given in the query string. Results are paged by the limit
+// and offset parameters.
+type registryJSON struct {
+	root     http.FileSystem
+	name     string
+	pad      bool // pad ragged rows instead of failing
+	maxLimit int  // largest page size; 0 for no limit
+}
+
+func (j registryJSON) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset, err := j.page(q)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := j.root.Open(j.name)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	t := newTSVReader(f)
+	header, err := t.next()
+	if err != nil && err != io.EOF {
+		log.Printf("%s: %v", j.name, err)
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	match, err := parseRowFilter(q, header)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A first pass counts the matching rows for X-Total-Count. It also finds
+	// ragged rows in strict mode while the status can still be changed.
+	total, err := j.count(r.Context(), t, len(header), match)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return // withTimeout or the client gave up
+		}
+		log.Printf("%s:%d: %v", j.name, t.line, err)
+		httpError(w, r, fmt.Sprintf("line %d: %v", t.line, err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("%s: %v", j.name, err)
+		httpError(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	t = newTSVReader(f)
+	t.next() // header
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Total-Count", strconv.Itoa(total))
+	if limit >= 0 && offset+limit < total {
+		h.Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPage(r, q, offset+limit)))
+	}
+
+	enc := keys(header)
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('[')
+	for seen, n := 0, 0; limit < 0 || n < limit; {
+		if r.Context().Err() != nil {
+			panic(http.ErrAbortHandler)
+		}
+		row, err := t.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			row, err = fitRow(row, len(header), j.pad)
+		}
+		if err != nil {
+			// The file changed since it was counted and the response is
+			// under way; all that is left is to cut it short so the client
+			// sees invalid JSON.
+			log.Printf("%s:%d: %v", j.name, t.line, err)
+			bw.Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if !match(row) {
+			continue
+		}
+		if seen++; seen <= offset {
+			continue
+		}
+		if n > 0 {
+			bw.WriteByte(',')
+		}
+		writeJSONObject(bw, enc, row)
+		n++
+	}
+	bw.WriteString("]\n")
+	bw.Flush()
+}
+
+// bounded reports whether r asks for a limited page, which is small enough
+// to coalesce; an unlimited one is streamed.
+func (j registryJSON) bounded(r *http.Request) bool {
+	limit, _, err := j.page(r.URL.Query())
+	return err == nil && limit >= 0
+}
+
+// page reads the limit and offset parameters. The limit is capped at
+// maxLimit, which is also used when none is given; -1 means unlimited.
+func (j registryJSON) page(q url.Values) (limit, offset int, err error) {
+	limit = -1
+	if j.maxLimit > 0 {
+		limit = j.maxLimit
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("limit %q must be a non-negative integer", s)
+		}
+		if limit < 0 || n < limit {
+			limit = n
+		}
+	}
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset %q must be a non-negative integer", s)
+		}
+	}
+	return limit, offset, nil
+}
+
+// count reads the remaining rows of t and returns how many match. It stops
+// early with the error of ctx once that is done.
+func (j registryJSON) count(ctx context.Context, t *tsvReader, cells int, match func(row []string) bool) (int, error) {
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		row, err := t.next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err == nil {
+			row, err = fitRow(row, cells, j.pad)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if match(row) {
+			total++
+		}
+	}
+}
+
+// nextPage returns the request's own URL with offset moved on. The path is
+// taken from RequestURI so that it keeps any mount prefix.
+func nextPage(r *http.Request, q url.Values, offset int) string {
+	p := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		p = u.Path
+	}
+	next := make(url.Values, len(q))
+	for k, v := range q {
+		next[k] = v
+	}
+	next.Set("offset", strconv.Itoa(offset))
+	return (&url.URL{Path: p, RawQuery: next.Encode()}).String()
+}
+
+// keys encodes the header cells as JSON strings.
+func keys(header []string) [][]byte {
+	out := make([][]byte, len(header))
+	for i, h := range header {
+		out[i], _ = json.Marshal(h)
+	}
+	return out
+}
+
+// parseRowFilter builds the row predicate selected by the col parameter
+// together with either eq, for an exact match of that column, or contains,
+// for a substring match. Without col every row matches.
+func parseRowFilter(q url.Values, header []string) (func(row []string) bool, error) {
+	col := q.Get("col")
+	_, hasEq := q["eq"]
+	_, hasContains := q["contains"]
+	if col == "" {
+		if hasEq || hasContains {
+			return nil, errors.New("eq and contains need a col parameter")
+		}
+		return func([]string) bool { return true }, nil
+	}
+	i := slices.Index(header, col)
+	if i < 0 {
+		return nil, fmt.Errorf("unknown column %q", col)
+	}
+	switch {
+	case hasEq && hasContains:
+		return nil, errors.New("use one of eq and contains")
+	case hasEq:
+		want := q.Get("eq")
+		return func(row []string) bool { return row[i] == want }, nil
+	case hasContains:
+		want := q.Get("contains")
+		return func(row []string) bool { return strings.Contains(row[i], want) }, nil
+	}
+	return nil, errors.New("col needs an eq or contains parameter")
+}
+
+// writeJSONObject writes one row as a JSON object. keys holds the header
+// cells already encoded as JSON strings.
+func writeJSONObject(w *bufio.Writer, keys [][]byte, row []string) {
+	w.WriteByte('{')
+	for i, cell := range row {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		v, _ := json.Marshal(cell)
+		w.Write(keys[i])
+		w.WriteByte(':')
+		w.Write(v)
+	}
+	w.WriteByte('}')
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// checkRegistry parses the registry file name in root and returns one error
+// per problem found, each naming its line: a missing or blank header cell,
+// or a row whose cell count differs from the header.
+func checkRegistry(root http.FileSystem, name string) []error {
+	f, err := root.Open(name)
+	if err != nil {
+		return []error{err}
+	}
+	defer f.Close()
+
+	t := newTSVReader(f)
+	header, err := t.next()
+	if err == io.EOF {
+		return []error{errors.New("no header row")}
+	}
+	if err != nil {
+		return []error{fmt.Errorf("line %d: %w", t.line, err)}
+	}
+
+	var errs []error
+	for i, cell := range header {
+		if strings.TrimSpace(cell) == "" {
+			errs = append(errs, fmt.Errorf("line %d: header column %d is empty", t.line, i+1))
+		}
+	}
+	for {
+		row, err := t.next()
+		if err == io.EOF {
+			return errs
+		}
+		if err != nil {
+			return append(errs, fmt.Errorf("line %d: %w", t.line+1, err))
+		}
+		if _, err := fitRow(row, len(header), false); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", t.line, err))
+		}
+	}
+}
+
+// validateRegistry checks the registry file according to mode, one of off,
+// warn or strict. Problems are logged; in strict mode they are also returned
+// as an error.
+func validateRegistry(mode string, root http.FileSystem, name string) error {
+	if mode == "off" {
+		return nil
+	}
+	errs := checkRegistry(root, name)
+	for _, err := range errs {
+		log.Printf("validate %s: %v", name, err)
+	}
+	if mode == "strict" && len(errs) > 0 {
+		return fmt.Errorf("validate %s: %d problem(s) found", name, len(errs))
+	}
+	return nil
+}